@@ -3,6 +3,7 @@
 package test
 
 import (
+	"github.com/go-yaaf/yaaf-common-valkey/valkey"
 	. "github.com/go-yaaf/yaaf-common/entity"
 	. "github.com/go-yaaf/yaaf-common/messaging"
 	"github.com/go-yaaf/yaaf-common/utils/binary"
@@ -107,6 +108,7 @@ func GetRandomHeroMessage(topic string) IMessage {
 
 type HeroMessage struct {
 	BaseMessage
+	facilities.MessageHeaders
 	Hero *Hero `json:"hero"`
 }
 
@@ -133,3 +133,51 @@ func (s *ValkeyCacheTestSuite) TestDataCacheScan() {
 		}
 	}
 }
+
+// TestDataCacheBlockingPop operation
+func (s *ValkeyCacheTestSuite) TestDataCacheBlockingPop() {
+
+	go func() {
+		time.Sleep(time.Second)
+		_ = s.cache.RPush("heroes-list", NewHero1("1", 1, "First"), NewHero1("2", 2, "Second"))
+	}()
+
+	key, result, err := s.cache.BRPop(NewHero, 5*time.Second, "heroes-list")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "heroes-list", key)
+	require.Equal(s.T(), "Second", result.NAME())
+
+	_, result, err = s.cache.BLPop(NewHero, 5*time.Second, "heroes-list")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "First", result.NAME())
+
+	// Timeout expires on empty list
+	_, _, err = s.cache.BLPop(NewHero, time.Second, "heroes-list")
+	require.ErrorIs(s.T(), err, facilities.ErrNotFound)
+}
+
+// TestDataCacheWatch keyspace notifications
+func (s *ValkeyCacheTestSuite) TestDataCacheWatch() {
+
+	watcher := s.cache.(facilities.IKeyspaceWatcher)
+	require.Nil(s.T(), watcher.EnableKeyspaceEvents())
+
+	events := make(chan facilities.KeyspaceEvent, 10)
+	handle, err := watcher.Watch("session:*", []facilities.KeyEvent{facilities.KeyEventExpired}, func(event facilities.KeyspaceEvent) {
+		events <- event
+	})
+	require.Nil(s.T(), err)
+	defer func() { _ = handle.Close() }()
+
+	// Give the watch time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	require.Nil(s.T(), s.cache.Set("session:1", NewHero1("1", 1, "Session"), time.Second))
+	select {
+	case event := <-events:
+		assert.Equal(s.T(), "session:1", event.Key)
+		assert.Equal(s.T(), facilities.KeyEventExpired, event.Event)
+	case <-time.After(time.Second * 5):
+		s.T().Fatal("expired event not received")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/go-yaaf/yaaf-common/messaging"
 	"github.com/go-yaaf/yaaf-common/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -98,12 +99,38 @@ func (s *ValkeyConsumerTestSuite) TestValkeyMessageBus_Consumer() {
 	logger.Info("Done")
 }
 
+func (s *ValkeyConsumerTestSuite) TestValkeyMessageBus_CloseWithFullBuffer() {
+
+	consumer, err := s.mq.CreateConsumer("", NewHeroMessage, "hero_full")
+	require.Nil(s.T(), err)
+	time.Sleep(time.Millisecond * 100)
+
+	// Fill the consumer buffer without reading, the receive loop is blocked on the full buffer
+	for i := 0; i < 1100; i++ {
+		require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_full")))
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	closed := make(chan struct{})
+	go func() {
+		_ = consumer.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 10):
+		s.T().Fatal("consumer close is blocked")
+	}
+}
+
 func consumerReader(c messaging.IMessageConsumer, wg *sync.WaitGroup) {
 	for {
 		message, err := c.Read(time.Second * 5)
 		if err != nil {
 			fmt.Println("consumer read error", err.Error())
 			wg.Done()
+			return
 		} else {
 			sm := message.(*HeroMessage)
 			logger.Info("[consumerReader] hero: %s", sm.Hero.NAME())
@@ -5,8 +5,11 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,7 +18,9 @@ import (
 	"github.com/go-yaaf/yaaf-common/messaging"
 	"github.com/go-yaaf/yaaf-common/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/valkey-io/valkey-go"
 )
 
 // ValkeyPubSubTestSuite creates a Valkey container with data for a suite of message queue tests and release it when done
@@ -72,6 +77,16 @@ func (s *ValkeyPubSubTestSuite) createSUT() messaging.IMessageBus {
 	return sut
 }
 
+// createBus creates message bus with the options for a single test, the bus is closed when the test ends
+func (s *ValkeyPubSubTestSuite) createBus(options ...facilities.BusOption) messaging.IMessageBus {
+
+	uri := fmt.Sprintf("valkey://localhost:%s", dbPort)
+	mq, err := facilities.NewValkeyMessageBus(uri, options...)
+	require.Nil(s.T(), err)
+	s.T().Cleanup(func() { _ = mq.Close() })
+	return mq
+}
+
 func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_PubSub() {
 
 	// Sync all publishers and consumers
@@ -87,3 +102,487 @@ func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_PubSub() {
 	wg.Wait()
 	logger.Info("Done")
 }
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_Unsubscribe() {
+
+	received := make(chan messaging.IMessage, 10)
+	callback := func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}
+
+	subId, err := s.mq.Subscribe("", NewHeroMessage, callback, "hero_unsubscribe")
+	require.Nil(s.T(), err)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_unsubscribe")))
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		s.T().Fatal("message not received")
+	}
+
+	assert.True(s.T(), s.mq.Unsubscribe(subId))
+	assert.False(s.T(), s.mq.Unsubscribe(subId))
+
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_unsubscribe")))
+	select {
+	case <-received:
+		s.T().Fatal("message received after unsubscribe")
+	case <-time.After(time.Second):
+	}
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_SubscriberGroups() {
+
+	var first, second, other atomic.Int32
+
+	sub1, err := s.mq.Subscribe("group", NewHeroMessage, func(msg messaging.IMessage) bool { first.Add(1); return true }, "hero_group")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(sub1)
+
+	sub2, err := s.mq.Subscribe("group", NewHeroMessage, func(msg messaging.IMessage) bool { second.Add(1); return true }, "hero_group")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(sub2)
+
+	sub3, err := s.mq.Subscribe("other_group", NewHeroMessage, func(msg messaging.IMessage) bool { other.Add(1); return true }, "hero_group")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(sub3)
+
+	for i := 0; i < 100; i++ {
+		require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_group")))
+	}
+
+	// Give the subscribers time to process all messages
+	time.Sleep(time.Second * 3)
+
+	// Members of the same group share the messages, other group gets all of them
+	assert.Equal(s.T(), int32(100), first.Load()+second.Load())
+	assert.Equal(s.T(), int32(100), other.Load())
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_GroupUnsubscribe() {
+
+	received := make(chan messaging.IMessage, 10)
+	callback := func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}
+
+	subId, err := s.mq.Subscribe("unsubscribe", NewHeroMessage, callback, "hero_group_unsubscribe")
+	require.Nil(s.T(), err)
+
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_group_unsubscribe")))
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		s.T().Fatal("message not received")
+	}
+
+	assert.True(s.T(), s.mq.Unsubscribe(subId))
+	assert.False(s.T(), s.mq.Unsubscribe(subId))
+
+	// The group is unregistered with its last member, messages are no longer queued for it
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_group_unsubscribe")))
+	select {
+	case <-received:
+		s.T().Fatal("message received after unsubscribe")
+	case <-time.After(time.Second):
+	}
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_GroupPatternTopic() {
+
+	// Group queues are created per exact topic, pattern topics can be subscribed only without name
+	_, err := s.mq.Subscribe("pattern_group", NewHeroMessage, func(msg messaging.IMessage) bool { return true }, "hero_pattern_*")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_GroupUnregister() {
+
+	inspector := s.mq.(facilities.IBusInspector)
+
+	sub1, err := s.mq.Subscribe("leaving", NewHeroMessage, func(msg messaging.IMessage) bool { return true }, "hero_leave")
+	require.Nil(s.T(), err)
+	sub2, err := s.mq.Subscribe("leaving", NewHeroMessage, func(msg messaging.IMessage) bool { return true }, "hero_leave")
+	require.Nil(s.T(), err)
+
+	// The group stays registered while it has a member
+	s.mq.Unsubscribe(sub1)
+	topics, err := inspector.Topics("hero_leave")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []string{"leaving"}, topics[0].Groups)
+
+	// The group registration is removed when the last member leaves
+	s.mq.Unsubscribe(sub2)
+	topics, err = inspector.Topics("hero_leave")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), 0, len(topics[0].Groups))
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_GroupUnsubscribeBuffered() {
+
+	processed := atomic.Int32{}
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	callback := func(msg messaging.IMessage) bool {
+		processed.Add(1)
+		select {
+		case started <- true:
+		default:
+		}
+		<-release
+		return true
+	}
+
+	// The first message blocks the ordered subscription while the rest are buffered
+	options := []facilities.SubscriptionOption{facilities.WithOrdered(), facilities.WithBuffer(5, facilities.OverflowBlock)}
+	subId, err := s.mq.(facilities.ISubscriber).SubscribeWith("buffered", NewHeroMessage, callback, options, "hero_buffered")
+	require.Nil(s.T(), err)
+
+	for i := 0; i < 20; i++ {
+		require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_buffered")))
+	}
+	<-started
+	time.Sleep(time.Millisecond * 500)
+
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		close(release)
+	}()
+	s.mq.Unsubscribe(subId)
+
+	// The messages which were not processed are returned to the group queue and delivered to the next member
+	subId, err = s.mq.Subscribe("buffered", NewHeroMessage, callback, "hero_buffered")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	for i := 0; i < 20 && processed.Load() < 20; i++ {
+		time.Sleep(time.Millisecond * 500)
+	}
+	assert.Equal(s.T(), int32(20), processed.Load())
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_DeadLetter() {
+
+	mq := s.createBus(facilities.WithDeadLetter(3))
+
+	// Always reject the message, it should be moved to the dead letter queue after 3 attempts
+	rejected := atomic.Int32{}
+	subId, err := mq.Subscribe("dead_letter", NewHeroMessage, func(msg messaging.IMessage) bool {
+		rejected.Add(1)
+		return false
+	}, "hero_pubsub_dead_letter")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	// Another group accepts the message, it should not get the requeued dead letter
+	accepted := atomic.Int32{}
+	otherId, err := mq.Subscribe("dead_letter_other", NewHeroMessage, func(msg messaging.IMessage) bool {
+		accepted.Add(1)
+		return true
+	}, "hero_pubsub_dead_letter")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(otherId)
+
+	require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_pubsub_dead_letter")))
+
+	dlq := mq.(facilities.IDeadLetterQueue)
+	defer func() { _ = dlq.PurgeDeadLetters("hero_pubsub_dead_letter") }()
+
+	var letters []facilities.DeadLetter
+	for i := 0; i < 10 && len(letters) == 0; i++ {
+		time.Sleep(time.Millisecond * 500)
+		letters, err = dlq.DeadLetters("hero_pubsub_dead_letter", "", 10)
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), 1, len(letters))
+	assert.Equal(s.T(), int64(3), letters[0].Attempts)
+	assert.Equal(s.T(), int32(3), rejected.Load())
+
+	// The requeued dead letter is delivered only to the group rejected it
+	require.Nil(s.T(), dlq.RequeueDeadLetters("hero_pubsub_dead_letter", letters[0].Id))
+	time.Sleep(time.Second * 2)
+	assert.Equal(s.T(), int32(6), rejected.Load())
+	assert.Equal(s.T(), int32(1), accepted.Load())
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_RetryPolicyRequiresGroup() {
+
+	mq := s.createBus(facilities.WithRetryPolicy(facilities.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Second}))
+
+	callback := func(msg messaging.IMessage) bool { return true }
+
+	// Subscriptions without name have no queue to retry from
+	_, err := mq.Subscribe("", NewHeroMessage, callback, "hero_retry_group")
+	assert.NotNil(s.T(), err)
+
+	subId, err := mq.Subscribe("retry_group", NewHeroMessage, callback, "hero_retry_group")
+	require.Nil(s.T(), err)
+	mq.Unsubscribe(subId)
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_ShardedPubSub() {
+
+	mq := s.createBus(facilities.WithShardedPubSub())
+
+	received := make(chan messaging.IMessage, 10)
+	callback := func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}
+
+	_, err := mq.Subscribe("", NewHeroMessage, callback, "hero_sharded_a", "hero_sharded_b")
+	require.Nil(s.T(), err)
+
+	// Pattern topics can't be subscribed in sharded mode
+	_, err = mq.Subscribe("", NewHeroMessage, callback, "hero_sharded_*")
+	assert.NotNil(s.T(), err)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_sharded_a"), GetRandomHeroMessage("hero_sharded_b")))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			s.T().Fatal("message not received")
+		}
+	}
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_ShardedPubSubMoved() {
+
+	// Run a single node cluster, removing the topic slot from the node unsubscribes the sharded topic (SUNSUBSCRIBE)
+	// the same way slot migration does
+	clusterName, clusterPort := "test-valkey-cluster", "6380"
+	err := utils.DockerUtils().CreateContainer("valkey/valkey:8.0.0").
+		Name(clusterName).
+		Port(clusterPort, clusterPort).
+		Label("env", "test").
+		EntryPoint("valkey-server", "--port", clusterPort, "--cluster-enabled", "yes", "--cluster-announce-ip", "127.0.0.1").
+		Run()
+	require.Nil(s.T(), err)
+	defer func() { _ = utils.DockerUtils().StopContainer(clusterName) }()
+
+	time.Sleep(5 * time.Second)
+
+	rc, err := valkey.NewClient(valkey.ClientOption{InitAddress: []string{"localhost:" + clusterPort}, ForceSingleClient: true})
+	require.Nil(s.T(), err)
+	defer rc.Close()
+
+	ctx := context.Background()
+	require.Nil(s.T(), rc.Do(ctx, rc.B().ClusterAddslotsrange().StartSlotEndSlot().StartSlotEndSlot(0, 16383).Build()).Error())
+	for i := 0; i < 30; i++ {
+		if info, _ := rc.Do(ctx, rc.B().ClusterInfo().Build()).ToString(); strings.Contains(info, "cluster_state:ok") {
+			break
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+
+	mq, err := facilities.NewValkeyMessageBus(fmt.Sprintf("valkey://localhost:%s", clusterPort), facilities.WithShardedPubSub())
+	require.Nil(s.T(), err)
+	defer func() { _ = mq.Close() }()
+
+	received := make(chan messaging.IMessage, 100)
+	subId, err := mq.Subscribe("", NewHeroMessage, func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}, "hero_moved")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	// The message is received until the topic is moved and again after the subscription is restored
+	expectMessage := func() {
+		for i := 0; i < 30; i++ {
+			_ = mq.Publish(GetRandomHeroMessage("hero_moved"))
+			select {
+			case <-received:
+				return
+			case <-time.After(time.Millisecond * 500):
+			}
+		}
+		s.T().Fatal("message not received")
+	}
+	expectMessage()
+
+	slot, err := rc.Do(ctx, rc.B().ClusterKeyslot().Key("hero_moved").Build()).AsInt64()
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), rc.Do(ctx, rc.B().ClusterDelslots().Slot(slot).Build()).Error())
+	time.Sleep(time.Second)
+	require.Nil(s.T(), rc.Do(ctx, rc.B().ClusterAddslots().Slot(slot).Build()).Error())
+
+	for len(received) > 0 {
+		<-received
+	}
+	expectMessage()
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_MixedTopics() {
+
+	received := make(chan messaging.IMessage, 10)
+	callback := func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}
+
+	// Pattern, exact and escaped topics in a single subscription
+	subId, err := s.mq.Subscribe("", NewHeroMessage, callback, "hero_orders.*", "hero_billing", facilities.EscapeTopic("hero_literal*"))
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	for _, topic := range []string{"hero_orders.new", "hero_billing", "hero_literal*", "hero_literal_other"} {
+		require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage(topic)))
+	}
+
+	topics := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-received:
+			topics[msg.Topic()] = true
+		case <-time.After(time.Second * 5):
+			s.T().Fatal("message not received")
+		}
+	}
+	assert.Equal(s.T(), map[string]bool{"hero_orders.new": true, "hero_billing": true, "hero_literal*": true}, topics)
+
+	select {
+	case msg := <-received:
+		s.T().Fatalf("unexpected message on topic %s", msg.Topic())
+	case <-time.After(time.Second):
+	}
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_OrderedSubscription() {
+
+	var mu sync.Mutex
+	received := make([]string, 0)
+	callback := func(msg messaging.IMessage) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, msg.SessionId())
+		return true
+	}
+
+	options := []facilities.SubscriptionOption{facilities.WithOrdered(), facilities.WithBuffer(100, facilities.OverflowBlock)}
+	subId, err := s.mq.(facilities.ISubscriber).SubscribeWith("", NewHeroMessage, callback, options, "hero_ordered")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	published := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		msg := GetRandomHeroMessage("hero_ordered")
+		published = append(published, msg.SessionId())
+		require.Nil(s.T(), s.mq.Publish(msg))
+	}
+
+	time.Sleep(time.Second * 2)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(s.T(), published, received)
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_RequestReply() {
+
+	rr := s.mq.(facilities.IRequestReply)
+
+	// The handler replies with the requested hero, or error for unknown hero
+	subId, err := rr.Serve("hero_lookup", NewHeroMessage, func(request messaging.IMessage) (messaging.IMessage, error) {
+		hero := request.(*HeroMessage).Hero
+		if hero == nil {
+			return nil, fmt.Errorf("hero not found")
+		}
+		return newHeroMessage("", hero), nil
+	})
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	request := GetRandomHeroMessage("hero_lookup")
+	reply, err := rr.Request(context.Background(), request, NewHeroMessage, time.Second*5)
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), request.Payload().(*Hero).Key, reply.Payload().(*Hero).Key)
+
+	_, err = rr.Request(context.Background(), &HeroMessage{BaseMessage: messaging.BaseMessage{MsgTopic: "hero_lookup"}}, NewHeroMessage, time.Second*5)
+	assert.EqualError(s.T(), err, "hero not found")
+
+	// No handler serves the topic
+	_, err = rr.Request(context.Background(), GetRandomHeroMessage("hero_no_lookup"), NewHeroMessage, time.Millisecond*500)
+	assert.NotNil(s.T(), err)
+
+	// Zero timeout waits for the reply or the context
+	_, err = rr.Request(context.Background(), GetRandomHeroMessage("hero_lookup"), NewHeroMessage, 0)
+	assert.Nil(s.T(), err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = rr.Request(ctx, GetRandomHeroMessage("hero_no_lookup"), NewHeroMessage, 0)
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_Deduplication() {
+
+	mq := s.createBus(facilities.WithDeduplication(time.Minute))
+
+	var received atomic.Int32
+	subId, err := mq.Subscribe("dedup", NewHeroMessage, func(msg messaging.IMessage) bool { received.Add(1); return true }, "hero_dedup")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	// The message is sent twice (same session id), the duplicate is skipped
+	message := GetRandomHeroMessage("hero_dedup")
+	require.Nil(s.T(), mq.Publish(message, message, GetRandomHeroMessage("hero_dedup")))
+
+	time.Sleep(time.Second)
+	assert.Equal(s.T(), int32(2), received.Load())
+	assert.Equal(s.T(), uint64(1), mq.(facilities.IDeduplicator).Duplicates())
+}
+
+func (s *ValkeyPubSubTestSuite) TestValkeyMessageBus_Introspection() {
+
+	inspector := s.mq.(facilities.IBusInspector)
+
+	subId, err := s.mq.Subscribe("", NewHeroMessage, func(msg messaging.IMessage) bool { return true }, "hero_inspect", "hero_inspect.*")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	groupId, err := s.mq.Subscribe("inspect", NewHeroMessage, func(msg messaging.IMessage) bool { return true }, "hero_inspect")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(groupId)
+
+	// Give the subscription time to be registered
+	time.Sleep(time.Millisecond * 500)
+
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_inspect")))
+	time.Sleep(time.Millisecond * 500)
+
+	channels, err := inspector.Channels("hero_inspect*")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []string{"hero_inspect"}, channels)
+
+	topics, err := inspector.Topics("hero_inspect")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(1), topics[0].Subscribers)
+	assert.Equal(s.T(), []string{"inspect"}, topics[0].Groups)
+
+	for _, info := range inspector.Subscriptions() {
+		if info.Id == subId || info.Id == groupId {
+			assert.Equal(s.T(), uint64(1), info.Received)
+			assert.Equal(s.T(), uint64(1), info.Processed)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/go-yaaf/yaaf-common/messaging"
 	"github.com/go-yaaf/yaaf-common/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -76,6 +78,16 @@ func (s *ValkeyQueueTestSuite) createSUT() messaging.IMessageBus {
 	return sut
 }
 
+// createBus creates message bus with the options for a single test, the bus is closed when the test ends
+func (s *ValkeyQueueTestSuite) createBus(options ...facilities.BusOption) messaging.IMessageBus {
+
+	uri := fmt.Sprintf("valkey://localhost:%s", dbPort)
+	mq, err := facilities.NewValkeyMessageBus(uri, options...)
+	require.Nil(s.T(), err)
+	s.T().Cleanup(func() { _ = mq.Close() })
+	return mq
+}
+
 func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_Pop() {
 
 	for {
@@ -110,3 +122,207 @@ func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_PopWithTimeout() {
 
 	fmt.Println("done")
 }
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_ReliablePop() {
+
+	mq := s.createBus(facilities.WithReliableQueue(time.Second * 2))
+
+	rq := mq.(facilities.IReliableQueue)
+	require.Nil(s.T(), mq.Push(GetRandomHeroMessage("reliable_queue")))
+
+	// Message which is not acknowledged is returned to the queue after the processing timeout
+	late, err := mq.Pop(NewHeroMessage, time.Second, "reliable_queue")
+	require.Nil(s.T(), err)
+
+	time.Sleep(time.Second * 4)
+
+	// The requeued message can't be acknowledged anymore
+	assert.ErrorIs(s.T(), rq.Ack(late), facilities.ErrNotFound)
+
+	msg, err := mq.Pop(NewHeroMessage, time.Second, "reliable_queue")
+	require.Nil(s.T(), err)
+	assert.Nil(s.T(), rq.Ack(msg))
+
+	// Acknowledged message is removed
+	_, err = mq.Pop(NewHeroMessage, time.Second, "reliable_queue")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_PopFrom() {
+
+	// Push message to queue_b after 2 seconds
+	go func() {
+		time.Sleep(time.Second * 2)
+		_ = s.mq.Push(GetRandomHeroMessage("queue_b"))
+	}()
+
+	mq := s.mq.(facilities.IMessageQueue)
+	queue, msg, err := mq.PopFrom(context.Background(), NewHeroMessage, time.Second*5, "queue_a", "queue_b")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), "queue_b", queue)
+	assert.Equal(s.T(), "queue_b", msg.Topic())
+
+	// Timeout is reported as not found
+	_, _, err = mq.PopFrom(context.Background(), NewHeroMessage, time.Second, "queue_a", "queue_b")
+	assert.ErrorIs(s.T(), err, facilities.ErrNotFound)
+
+	// Canceled context aborts the blocking pop
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, _, err = mq.PopFrom(ctx, NewHeroMessage, time.Second*10, "queue_a")
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_PushDelayed() {
+
+	dq := s.mq.(facilities.IDelayedQueue)
+	require.Nil(s.T(), dq.PushDelayed(time.Second*3, GetRandomHeroMessage("delayed_queue")))
+
+	// The message is not visible before the delay expires
+	_, err := s.mq.Pop(NewHeroMessage, time.Second, "delayed_queue")
+	assert.ErrorIs(s.T(), err, facilities.ErrNotFound)
+
+	msg, err := s.mq.Pop(NewHeroMessage, time.Second*5, "delayed_queue")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), "delayed_queue", msg.Topic())
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_PriorityPop() {
+
+	mq := s.createBus(facilities.WithPriorities(2))
+
+	pq := mq.(facilities.IPriorityQueue)
+	require.Nil(s.T(), mq.Push(newHeroMessage("priority_queue", &Hero{Key: 1, Name: "Bulk"})))
+	require.Nil(s.T(), pq.PushWithPriority(2, newHeroMessage("priority_queue", &Hero{Key: 2, Name: "Urgent"})))
+	require.Nil(s.T(), pq.PushWithPriority(1, newHeroMessage("priority_queue", &Hero{Key: 3, Name: "High"})))
+
+	// Messages are popped from the highest priority
+	for _, name := range []string{"Urgent", "High", "Bulk"} {
+		msg, er := mq.Pop(NewHeroMessage, time.Second, "priority_queue")
+		require.Nil(s.T(), er)
+		assert.Equal(s.T(), name, msg.Payload().(*Hero).Name)
+	}
+
+	// Priority above the configured levels is rejected
+	assert.NotNil(s.T(), pq.PushWithPriority(3, GetRandomHeroMessage("priority_queue")))
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_BulkPush() {
+
+	messages := make([]messaging.IMessage, 0, 100)
+	for i := 0; i < 100; i++ {
+		messages = append(messages, GetRandomHeroMessage("bulk_queue"))
+	}
+	require.Nil(s.T(), s.mq.Push(messages...))
+
+	for i := 0; i < 100; i++ {
+		_, err := s.mq.Pop(NewHeroMessage, 0, "bulk_queue")
+		require.Nil(s.T(), err)
+	}
+
+	// Atomic batch is sent in a single transaction
+	mq := s.createBus(facilities.WithAtomicBatch())
+
+	require.Nil(s.T(), mq.Push(GetRandomHeroMessage("bulk_queue"), GetRandomHeroMessage("bulk_queue")))
+	for i := 0; i < 2; i++ {
+		_, err := mq.Pop(NewHeroMessage, 0, "bulk_queue")
+		require.Nil(s.T(), err)
+	}
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_Headers() {
+
+	mq := s.createBus(facilities.WithHeaders(func(message messaging.IMessage, headers map[string]string) {
+		headers[facilities.HeaderProducerId] = "heroes-producer"
+	}))
+
+	message := GetRandomHeroMessage("headers_queue").(*HeroMessage)
+	message.SetHeader(facilities.HeaderTraceParent, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.Nil(s.T(), mq.Push(message))
+
+	msg, err := mq.Pop(NewHeroMessage, time.Second, "headers_queue")
+	require.Nil(s.T(), err)
+	received := msg.(*HeroMessage)
+	assert.Equal(s.T(), message.Hero.Name, received.Hero.Name)
+	assert.Equal(s.T(), "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", received.Header(facilities.HeaderTraceParent))
+	assert.Equal(s.T(), "heroes-producer", received.Header(facilities.HeaderProducerId))
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_PushDeduplication() {
+
+	mq := s.createBus(facilities.WithPushDeduplication(time.Minute), facilities.WithPriorities(2))
+
+	// The same message pushed twice is queued once, also by the priority and delayed pushes
+	message := GetRandomHeroMessage("dedup_queue")
+	require.Nil(s.T(), mq.Push(message, message))
+	require.Nil(s.T(), mq.Push(message))
+	require.Nil(s.T(), mq.(facilities.IPriorityQueue).PushWithPriority(1, message))
+	require.Nil(s.T(), mq.(facilities.IDelayedQueue).PushAt(time.Now(), message))
+
+	_, err := mq.Pop(NewHeroMessage, 0, "dedup_queue")
+	require.Nil(s.T(), err)
+	_, err = mq.Pop(NewHeroMessage, time.Second*2, "dedup_queue")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_QueueManagement() {
+
+	qm := s.mq.(facilities.IQueueManager)
+	defer func() { _ = qm.Purge("{manage}:target") }()
+
+	messages := make([]messaging.IMessage, 0, 10)
+	for i := 0; i < 10; i++ {
+		messages = append(messages, GetRandomHeroMessage("{manage}:source"))
+	}
+	require.Nil(s.T(), s.mq.Push(messages...))
+
+	length, err := qm.QueueLength("{manage}:source")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(10), length)
+
+	// Peek returns the messages in pop order without removing them
+	peeked, err := qm.Peek(NewHeroMessage, "{manage}:source", 3)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 3, len(peeked))
+	assert.Equal(s.T(), messages[0].SessionId(), peeked[0].SessionId())
+
+	removed, err := qm.Remove(NewHeroMessage, "{manage}:source", func(message messaging.IMessage) bool {
+		return message.SessionId() == messages[1].SessionId()
+	})
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(1), removed)
+
+	moved, err := qm.MoveAll("{manage}:source", "{manage}:target")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(9), moved)
+
+	length, err = qm.QueueLength("{manage}:source")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(0), length)
+
+	require.Nil(s.T(), qm.Purge("{manage}:target"))
+	length, err = qm.QueueLength("{manage}:target")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(0), length)
+}
+
+func (s *ValkeyQueueTestSuite) TestValkeyMessageBus_MessageTTL() {
+
+	mq := s.createBus(facilities.WithExpiredSink("ttl_expired"))
+
+	// The expired message is skipped by Pop and moved to the expired sink
+	expiring := GetRandomHeroMessage("ttl_queue")
+	require.Nil(s.T(), mq.(facilities.IMessageExpiration).PushWithTTL(time.Millisecond*100, expiring))
+	live := GetRandomHeroMessage("ttl_queue")
+	require.Nil(s.T(), mq.Push(live))
+	time.Sleep(time.Millisecond * 200)
+
+	message, err := mq.Pop(NewHeroMessage, time.Second, "ttl_queue")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), live.SessionId(), message.SessionId())
+	assert.Equal(s.T(), uint64(1), mq.(facilities.IMessageExpiration).Expired())
+
+	message, err = mq.Pop(NewHeroMessage, 0, "ttl_expired")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), expiring.SessionId(), message.SessionId())
+}
@@ -0,0 +1,412 @@
+//
+// Integration tests of Valkey stream based message bus implementation
+//
+
+package test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-yaaf/yaaf-common-valkey/valkey"
+	"github.com/go-yaaf/yaaf-common/messaging"
+	"github.com/go-yaaf/yaaf-common/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// ValkeyStreamBusTestSuite creates a Valkey container for a suite of stream message bus tests and release it when done
+type ValkeyStreamBusTestSuite struct {
+	suite.Suite
+	containerID string
+	mq          messaging.IMessageBus
+}
+
+func TestValkeyStreamBusTestSuite(t *testing.T) {
+	skipCI(t)
+	suite.Run(t, new(ValkeyStreamBusTestSuite))
+}
+
+// SetupSuite will run once when the test suite begins
+func (s *ValkeyStreamBusTestSuite) SetupSuite() {
+
+	// Create command to run Valkey container
+	err := utils.DockerUtils().CreateContainer("valkey/valkey:8.0.0").
+		Name(containerName).
+		Port(dbPort, dbPort).
+		Label("env", "test").
+		Run()
+
+	assert.Nil(s.T(), err)
+
+	// Give it 5 seconds to warm up
+	time.Sleep(5 * time.Second)
+
+	// Create and initialize
+	s.mq = s.createSUT()
+}
+
+// TearDownSuite will be run once at the end of the testing suite, after all tests have been run
+func (s *ValkeyStreamBusTestSuite) TearDownSuite() {
+	err := utils.DockerUtils().StopContainer(containerName)
+	assert.Nil(s.T(), err)
+}
+
+// createSUT creates the system-under-test which is Valkey stream implementation of IMessageBus
+func (s *ValkeyStreamBusTestSuite) createSUT() messaging.IMessageBus {
+
+	uri := fmt.Sprintf("valkey://localhost:%s", dbPort)
+	sut, err := facilities.NewValkeyStreamBus(uri)
+	if err != nil {
+		panic(any(err))
+	}
+
+	if err := sut.Ping(5, 5); err != nil {
+		fmt.Println("error pinging database")
+		panic(any(err))
+	}
+
+	return sut
+}
+
+// createBus creates stream message bus with the options for a single test, the bus is closed when the test ends
+func (s *ValkeyStreamBusTestSuite) createBus(options ...facilities.BusOption) messaging.IMessageBus {
+
+	uri := fmt.Sprintf("valkey://localhost:%s", dbPort)
+	mq, err := facilities.NewValkeyStreamBus(uri, options...)
+	require.Nil(s.T(), err)
+	s.T().Cleanup(func() { _ = mq.Close() })
+	return mq
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_Durable() {
+
+	received := make(chan messaging.IMessage, 10)
+	callback := func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}
+
+	// Create the consumer group and stop the subscriber
+	subId, err := s.mq.Subscribe("durable", NewHeroMessage, callback, "hero_stream")
+	require.Nil(s.T(), err)
+	assert.True(s.T(), s.mq.Unsubscribe(subId))
+
+	// Messages published while the subscriber is down are delivered when it is back
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_stream")))
+
+	subId, err = s.mq.Subscribe("durable", NewHeroMessage, callback, "hero_stream")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	select {
+	case msg := <-received:
+		fmt.Println("received hero:", msg.(*HeroMessage).Hero.NAME())
+	case <-time.After(time.Second * 10):
+		s.T().Fatal("message not received")
+	}
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_Consumer() {
+
+	consumer, err := s.mq.CreateConsumer("stream_consumer", NewHeroMessage, "hero_stream_consumer")
+	require.Nil(s.T(), err)
+	defer func() { _ = consumer.Close() }()
+
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_stream_consumer")))
+
+	msg, err := consumer.Read(time.Second * 5)
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), "hero_stream_consumer", msg.Topic())
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_ConsumerTopics() {
+
+	topics := []string{"hero_consumer_first", "hero_consumer_second"}
+	consumer, err := s.mq.CreateConsumer("topics_consumer", NewHeroMessage, topics...)
+	require.Nil(s.T(), err)
+	defer func() { _ = consumer.Close() }()
+
+	// Both messages are published before the first read, each read returns one of them
+	for _, topic := range topics {
+		require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage(topic)))
+	}
+
+	received := make([]string, 0, len(topics))
+	for range topics {
+		msg, err := consumer.Read(time.Second * 5)
+		require.Nil(s.T(), err)
+		received = append(received, msg.Topic())
+	}
+	assert.ElementsMatch(s.T(), topics, received)
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_EscapedTopic() {
+
+	received := make(chan messaging.IMessage, 10)
+	callback := func(msg messaging.IMessage) bool {
+		received <- msg
+		return true
+	}
+
+	// Pattern topics are not supported, escaped topic is subscribed as exact topic
+	_, err := s.mq.Subscribe("escaped", NewHeroMessage, callback, "hero_escaped*")
+	assert.NotNil(s.T(), err)
+
+	subId, err := s.mq.Subscribe("escaped", NewHeroMessage, callback, facilities.EscapeTopic("hero_escaped*"))
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	require.Nil(s.T(), s.mq.Publish(GetRandomHeroMessage("hero_escaped*")))
+	select {
+	case msg := <-received:
+		assert.Equal(s.T(), "hero_escaped*", msg.Topic())
+	case <-time.After(time.Second * 5):
+		s.T().Fatal("message not received")
+	}
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_Redelivery() {
+
+	mq := s.createBus(facilities.WithVisibilityTimeout(time.Second), facilities.WithReclaimInterval(time.Second))
+
+	// Reject the message on the first delivery, it should be redelivered after the visibility timeout
+	deliveries := make(chan int, 10)
+	count := atomic.Int32{}
+	callback := func(msg messaging.IMessage) bool {
+		delivery := int(count.Add(1))
+		deliveries <- delivery
+		return delivery > 1
+	}
+
+	subId, err := mq.Subscribe("redelivery", NewHeroMessage, callback, "hero_redelivery")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_redelivery")))
+
+	for expected := 1; expected <= 2; expected++ {
+		select {
+		case delivery := <-deliveries:
+			assert.Equal(s.T(), expected, delivery)
+		case <-time.After(time.Second * 15):
+			s.T().Fatalf("delivery %d not received", expected)
+		}
+	}
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_ReclaimInflight() {
+
+	mq := s.createBus(facilities.WithVisibilityTimeout(time.Second), facilities.WithReclaimInterval(time.Second))
+
+	// The messages wait in the ordered subscription buffer longer than the visibility timeout, they are not redelivered
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	callback := func(msg messaging.IMessage) bool {
+		time.Sleep(time.Millisecond * 700)
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries[msg.SessionId()]++
+		return true
+	}
+
+	subId, err := mq.Subscribe("inflight", NewHeroMessage, callback, "hero_inflight")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	for i := 0; i < 5; i++ {
+		require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_inflight")))
+	}
+	time.Sleep(time.Second * 6)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(s.T(), 5, len(deliveries))
+	for _, count := range deliveries {
+		assert.Equal(s.T(), 1, count)
+	}
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_DeadLetter() {
+
+	mq := s.createBus(
+		facilities.WithVisibilityTimeout(time.Second),
+		facilities.WithReclaimInterval(time.Second),
+		facilities.WithDeadLetter(2))
+
+	// Always reject the message, it should be moved to the dead letter queue after 2 attempts
+	rejected := make(chan bool, 10)
+	subId, err := mq.Subscribe("dead_letter", NewHeroMessage, func(msg messaging.IMessage) bool {
+		rejected <- true
+		return false
+	}, "hero_dead_letter")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	// Another group accepts the message, it should not get the requeued dead letter
+	accepted := atomic.Int32{}
+	otherId, err := mq.Subscribe("dead_letter_other", NewHeroMessage, func(msg messaging.IMessage) bool {
+		accepted.Add(1)
+		return true
+	}, "hero_dead_letter")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(otherId)
+
+	require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_dead_letter")))
+
+	dlq := mq.(facilities.IDeadLetterQueue)
+	defer func() { _ = dlq.PurgeDeadLetters("hero_dead_letter") }()
+
+	var letters []facilities.DeadLetter
+	for i := 0; i < 30 && len(letters) == 0; i++ {
+		time.Sleep(time.Millisecond * 500)
+		letters, err = dlq.DeadLetters("hero_dead_letter", "", 10)
+		require.Nil(s.T(), err)
+	}
+
+	require.Equal(s.T(), 1, len(letters))
+	assert.Equal(s.T(), "dead_letter", letters[0].Subscriber)
+	assert.Equal(s.T(), int64(2), letters[0].Attempts)
+
+	msg, err := letters[0].Message(NewHeroMessage)
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), "hero_dead_letter", msg.Topic())
+
+	// The requeued dead letter is delivered only to the group rejected it
+	for len(rejected) > 0 {
+		<-rejected
+	}
+	require.Nil(s.T(), dlq.RequeueDeadLetters("hero_dead_letter", letters[0].Id))
+	select {
+	case <-rejected:
+	case <-time.After(time.Second * 5):
+		s.T().Fatalf("requeued dead letter not received")
+	}
+	assert.Equal(s.T(), int32(1), accepted.Load())
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_RetryPolicy() {
+
+	mq := s.createBus(
+		facilities.WithRetryPolicy(facilities.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond * 500, Multiplier: 2}),
+		facilities.WithDeadLetter(1))
+
+	// Always reject the message, it should be retried twice and then moved to the dead letter queue
+	retries := make(chan string, 10)
+	subId, err := mq.Subscribe("retry", NewHeroMessage, func(msg messaging.IMessage) bool {
+		retries <- msg.(*HeroMessage).Header(facilities.HeaderRetryCount)
+		return false
+	}, "hero_retry")
+	require.Nil(s.T(), err)
+	defer mq.Unsubscribe(subId)
+
+	dlq := mq.(facilities.IDeadLetterQueue)
+	defer func() { _ = dlq.PurgeDeadLetters("hero_retry") }()
+
+	require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_retry")))
+
+	for _, expected := range []string{"", "1", "2"} {
+		select {
+		case count := <-retries:
+			assert.Equal(s.T(), expected, count)
+		case <-time.After(time.Second * 5):
+			s.T().Fatalf("retry %s not received", expected)
+		}
+	}
+
+	var letters []facilities.DeadLetter
+	for i := 0; i < 10 && len(letters) == 0; i++ {
+		time.Sleep(time.Millisecond * 500)
+		letters, err = dlq.DeadLetters("hero_retry", "", 10)
+		require.Nil(s.T(), err)
+	}
+
+	require.Equal(s.T(), 1, len(letters))
+	assert.Equal(s.T(), int64(3), letters[0].Attempts)
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_Retention() {
+
+	mq := s.createBus(facilities.WithStreamRetention("hero_retention", facilities.RetentionPolicy{Acked: true}))
+
+	consumer, err := mq.CreateConsumer("retention", NewHeroMessage, "hero_retention")
+	require.Nil(s.T(), err)
+	defer func() { _ = consumer.Close() }()
+
+	for i := 0; i < 5; i++ {
+		require.Nil(s.T(), mq.Publish(GetRandomHeroMessage("hero_retention")))
+	}
+
+	// Only the messages acknowledged by the consumer group are trimmed
+	for i := 0; i < 3; i++ {
+		_, err = consumer.Read(time.Second * 5)
+		require.Nil(s.T(), err)
+	}
+	trimmed, err := mq.(facilities.IStreamRetention).Trim()
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(3), trimmed)
+
+	for i := 0; i < 2; i++ {
+		_, err = consumer.Read(time.Second * 5)
+		require.Nil(s.T(), err)
+	}
+	trimmed, err = mq.(facilities.IStreamRetention).Trim("hero_retention")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(2), trimmed)
+}
+
+func (s *ValkeyStreamBusTestSuite) TestValkeyStreamBus_Replay() {
+
+	published := make([]messaging.IMessage, 0, 5)
+	for i := 0; i < 5; i++ {
+		message := GetRandomHeroMessage("hero_replay")
+		require.Nil(s.T(), s.mq.Publish(message))
+		published = append(published, message)
+	}
+
+	// Replay the topic history in order
+	replayed := make([]string, 0, 5)
+	count, err := s.mq.(facilities.IStreamReplay).Replay("hero_replay", NewHeroMessage, facilities.OffsetEarliest, facilities.OffsetLatest, func(msg messaging.IMessage) bool {
+		replayed = append(replayed, msg.SessionId())
+		return true
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(5), count)
+	for i, message := range published {
+		assert.Equal(s.T(), message.SessionId(), replayed[i])
+	}
+
+	// A new subscriber group starting from the earliest message receives the published messages
+	received := make(chan string, 10)
+	options := []facilities.SubscriptionOption{facilities.StartFrom(facilities.OffsetEarliest)}
+	subId, err := s.mq.(facilities.ISubscriber).SubscribeWith("replay", NewHeroMessage, func(msg messaging.IMessage) bool {
+		received <- msg.SessionId()
+		return true
+	}, options, "hero_replay")
+	require.Nil(s.T(), err)
+	defer s.mq.Unsubscribe(subId)
+
+	for _, message := range published {
+		select {
+		case id := <-received:
+			assert.Equal(s.T(), message.SessionId(), id)
+		case <-time.After(time.Second * 5):
+			s.T().Fatalf("message %s not received", message.SessionId())
+		}
+	}
+
+	// A new consumer group starting from the earliest message reads the published messages
+	consumer, err := s.mq.(facilities.IStreamConsumer).CreateConsumerWith("replay_consumer", NewHeroMessage, options, "hero_replay")
+	require.Nil(s.T(), err)
+	defer func() { _ = consumer.Close() }()
+
+	for _, message := range published {
+		msg, er := consumer.Read(time.Second * 5)
+		require.Nil(s.T(), er)
+		assert.Equal(s.T(), message.SessionId(), msg.SessionId())
+	}
+}
@@ -0,0 +1,200 @@
+// Bulk messages: the commands of multiple messages are sent in a single round trip (pipeline) or transaction
+//
+
+package facilities
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/valkey-io/valkey-go"
+
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// errBatchAborted is reported for the valid messages of an atomic batch which was not sent due to other messages
+var errBatchAborted = fmt.Errorf("atomic batch aborted")
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// BatchError is returned by the bulk actions (Publish, Push) when some of the messages were not accepted
+// The errors are ordered as the messages, nil error means the message was accepted
+type BatchError struct {
+	Errors []error
+}
+
+// Error returns the number of failed messages and the first error
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	if first == nil {
+		return fmt.Sprintf("%d of %d messages failed", failed, len(e.Errors))
+	}
+	return fmt.Sprintf("%d of %d messages failed: %s", failed, len(e.Errors), first.Error())
+}
+
+// Unwrap returns the errors of the failed messages
+func (e *BatchError) Unwrap() []error {
+	result := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// Accepted checks if the message in the given index was accepted
+func (e *BatchError) Accepted(index int) bool {
+	return index >= 0 && index < len(e.Errors) && e.Errors[index] == nil
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// batch collects the commands of bulk messages, messages which can't be encoded are reported without a command
+type batch struct {
+	errs  []error
+	index []int           // The message index of every command
+	keys  []string        // The keys of all the commands
+	cmds  valkey.Commands // The commands to send
+	evals valkey.Commands // The commands sent in transactions, for script commands (EVALSHA) including the script source (EVAL)
+}
+
+// newBatch creates batch of the given number of messages
+func newBatch(size int) *batch {
+	return &batch{
+		errs:  make([]error, size),
+		index: make([]int, 0, size),
+		cmds:  make(valkey.Commands, 0, size),
+		evals: make(valkey.Commands, 0, size),
+	}
+}
+
+// add the command of the message in the given index
+func (b *batch) add(index int, cmd valkey.Completed, keys ...string) {
+	b.addScript(index, cmd, cmd, keys...)
+}
+
+// addScript adds the script command (EVALSHA) of the message in the given index and its fallback (EVAL) used when
+// the script is not loaded and in transactions
+func (b *batch) addScript(index int, evalsha, eval valkey.Completed, keys ...string) {
+	b.index = append(b.index, index)
+	b.cmds = append(b.cmds, evalsha)
+	b.evals = append(b.evals, eval)
+	b.keys = append(b.keys, keys...)
+}
+
+// fail reports error for the message in the given index
+func (b *batch) fail(index int, err error) {
+	b.errs[index] = err
+}
+
+// exec sends the commands in a single round trip, or in a single transaction (MULTI/EXEC) in atomic mode
+// Return BatchError if some of the messages were not accepted
+func (b *batch) exec(rc valkey.Client, atomic bool) error {
+
+	if atomic {
+		b.execAtomic(rc)
+	} else if len(b.cmds) > 0 {
+		retry := make([]int, 0)
+		for i, res := range rc.DoMulti(context.Background(), b.cmds...) {
+			if err, ok := valkey.IsValkeyErr(res.Error()); ok && err.IsNoScript() {
+				retry = append(retry, i)
+			} else {
+				b.errs[b.index[i]] = res.Error()
+			}
+		}
+
+		// Send the script source for the commands of scripts which are not loaded yet
+		if len(retry) > 0 {
+			evals := make(valkey.Commands, 0, len(retry))
+			for _, i := range retry {
+				evals = append(evals, b.evals[i])
+			}
+			for j, res := range rc.DoMulti(context.Background(), evals...) {
+				b.errs[b.index[retry[j]]] = res.Error()
+			}
+		}
+	}
+
+	for _, err := range b.errs {
+		if err != nil {
+			return &BatchError{Errors: b.errs}
+		}
+	}
+	return nil
+}
+
+// execAtomic sends the commands in a single transaction, no command is sent if any of the messages is invalid
+func (b *batch) execAtomic(rc valkey.Client) {
+
+	var abort error
+	for _, err := range b.errs {
+		if err != nil {
+			abort = errBatchAborted
+		}
+	}
+	if abort == nil && !sameSlot(rc, b.keys...) {
+		abort = fmt.Errorf("atomic batch requires all the messages in the same cluster slot")
+	}
+	if abort == nil && len(b.cmds) > 0 {
+		abort = rc.Dedicated(func(dc valkey.DedicatedClient) error {
+
+			// Scripts are sent with their source since EVALSHA of missing script fails inside the transaction
+			multi := make(valkey.Commands, 0, len(b.evals)+2)
+			multi = append(multi, dc.B().Multi().Build())
+			multi = append(multi, b.evals...)
+			multi = append(multi, dc.B().Exec().Build())
+
+			results := dc.DoMulti(context.Background(), multi...)
+			replies, err := results[len(results)-1].ToArray()
+			if err != nil {
+				return err
+			}
+			for i, reply := range replies {
+				b.errs[b.index[i]] = reply.Error()
+			}
+			return nil
+		})
+	}
+
+	if abort != nil {
+		for _, i := range b.index {
+			b.errs[i] = abort
+		}
+	}
+}
+
+// encodeBatch encodes the messages (with the headers of the injectors) and adds the command built for each of them
+// to the batch
+func encodeBatch(messages []IMessage, injectors []HeaderInjector, build func(b *batch, index int, message IMessage, raw string)) *batch {
+	b := newBatch(len(messages))
+	for i, message := range messages {
+		if bytes, err := messageToRaw(message, injectors...); err != nil {
+			b.fail(i, err)
+		} else {
+			build(b, i, message, string(bytes))
+		}
+	}
+	return b
+}
+
+// scriptSha returns the SHA1 digest of the script source used to execute it by EVALSHA
+func scriptSha(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// endregion
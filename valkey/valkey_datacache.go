@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/valkey-io/valkey-go"
+
 	. "github.com/go-yaaf/yaaf-common/database"
 	. "github.com/go-yaaf/yaaf-common/entity"
 )
@@ -375,55 +377,42 @@ func (r *ValkeyAdapter) LPop(factory EntityFactory, key string) (entity Entity,
 }
 
 // BRPop Remove and get the last element in a list or block until one is available
+// Use 0 timeout to block indefinitely, ErrNotFound is returned when the timeout expires
 func (r *ValkeyAdapter) BRPop(factory EntityFactory, timeout time.Duration, keys ...string) (key string, entity Entity, err error) {
 
-	cmd := r.rc.B().Brpop().Key(keys...).Timeout(float64(timeout)).Build()
-	res := r.rc.Do(context.Background(), cmd)
-	if res.Error() != nil {
-		return "", nil, res.Error()
+	if !sameSlot(r.rc, keys...) {
+		return "", nil, fmt.Errorf("keys must be in the same cluster slot")
 	}
 
-	/*
-		if cmd := r.rc.BRPop(r.ctx, timeout, keys...); cmd.Err() != nil {
-			return "", nil, err
-		} else {
-			if result, er := cmd.Result(); er != nil {
-				return "", nil, err
-			} else {
-				key = result[0]
-				entity, err = rawToEntity(factory, []byte(result[1]))
-				return
-			}
-		}
-
-	*/
-	return "", nil, fmt.Errorf("not implemented yet")
+	cmd := r.rc.B().Brpop().Key(keys...).Timeout(timeout.Seconds()).Build()
+	return r.blockingPop(factory, cmd)
 }
 
 // BLPop Remove and get the first element in a list or block until one is available
+// Use 0 timeout to block indefinitely, ErrNotFound is returned when the timeout expires
 func (r *ValkeyAdapter) BLPop(factory EntityFactory, timeout time.Duration, keys ...string) (key string, entity Entity, err error) {
 
-	cmd := r.rc.B().Blpop().Key(keys...).Timeout(float64(timeout)).Build()
-	res := r.rc.Do(context.Background(), cmd)
-	if res.Error() != nil {
-		return "", nil, res.Error()
+	if !sameSlot(r.rc, keys...) {
+		return "", nil, fmt.Errorf("keys must be in the same cluster slot")
 	}
 
-	/*
-		if cmd := r.rc.BLPop(r.ctx, timeout, keys...); cmd.Err() != nil {
-			return "", nil, err
-		} else {
-			if result, er := cmd.Result(); er != nil {
-				return "", nil, err
-			} else {
-				key = result[0]
-				entity, err = rawToEntity(factory, []byte(result[1]))
-				return
-			}
-		}
+	cmd := r.rc.B().Blpop().Key(keys...).Timeout(timeout.Seconds()).Build()
+	return r.blockingPop(factory, cmd)
+}
+
+// blockingPop executes blocking pop command, the reply is the pair of the key and the element or nil when timeout expired
+func (r *ValkeyAdapter) blockingPop(factory EntityFactory, cmd valkey.Completed) (key string, entity Entity, err error) {
+
+	values, err := r.rc.Do(context.Background(), cmd).AsStrSlice()
+	if valkey.IsValkeyNil(err) {
+		return "", nil, ErrNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
 
-	*/
-	return "", nil, fmt.Errorf("not implemented yet")
+	entity, err = rawToEntity(factory, []byte(values[1]))
+	return values[0], entity, err
 }
 
 // LRange Get a range of elements from list
@@ -0,0 +1,219 @@
+// Dead letter queue of messages rejected by the subscription callbacks
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+
+	. "github.com/go-yaaf/yaaf-common/entity"
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// errRejected is returned by invoke when the subscription callback rejected the message (returned false)
+var errRejected = fmt.Errorf("message rejected by subscriber")
+
+// deadLetterBackoff is the backoff between the attempts of a pub/sub message rejected by the subscription callback
+// before it is moved to the dead letter queue (when retry policy is not configured)
+var deadLetterBackoff = RetryPolicy{InitialDelay: 100 * time.Millisecond, Multiplier: 2, MaxDelay: 5 * time.Second}
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IDeadLetterQueue is implemented by the Valkey message buses to manage the topic dead letter queue (<topic>:dlq)
+type IDeadLetterQueue interface {
+
+	// DeadLetters lists up to limit dead letters of the topic, starting from the given dead letter id (use "-" for the first)
+	DeadLetters(topic string, from string, limit int64) ([]DeadLetter, error)
+
+	// DeadLetter gets a single dead letter of the topic
+	DeadLetter(topic string, id string) (DeadLetter, error)
+
+	// RequeueDeadLetters deliver the dead letters again and remove them from the dead letter queue
+	RequeueDeadLetters(topic string, ids ...string) error
+
+	// PurgeDeadLetters removes all the dead letters of the topic
+	PurgeDeadLetters(topic string) error
+}
+
+// DeadLetter is a message rejected by a subscriber, including the raw message and the error metadata
+type DeadLetter struct {
+	Id         string    `json:"id"`         // Dead letter id
+	Topic      string    `json:"topic"`      // Message topic (channel)
+	Subscriber string    `json:"subscriber"` // The name of the subscriber rejected the message
+	Attempts   int64     `json:"attempts"`   // Number of delivery attempts
+	LastError  string    `json:"lastError"`  // The last processing error
+	Timestamp  Timestamp `json:"timestamp"`  // The time the message was moved to the dead letter queue
+	Payload    []byte    `json:"payload"`    // The raw message
+}
+
+// Message decodes the dead letter payload to message
+func (d *DeadLetter) Message(factory MessageFactory) (IMessage, error) {
+	return rawToMessage(factory, d.Payload)
+}
+
+// endregion
+
+// region Dead letter queue actions ------------------------------------------------------------------------------------
+
+// DeadLetters lists up to limit dead letters of the topic, starting from the given dead letter id (use "-" for the first)
+func (r *ValkeyAdapter) DeadLetters(topic string, from string, limit int64) ([]DeadLetter, error) {
+
+	if len(from) == 0 {
+		from = "-"
+	}
+
+	cmd := r.rc.B().Xrange().Key(deadLetterKey(topic)).Start(from).End("+").Count(limit).Build()
+	entries, err := r.rc.Do(context.Background(), cmd).AsXRange()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entryToDeadLetter(topic, entry))
+	}
+	return result, nil
+}
+
+// DeadLetter gets a single dead letter of the topic
+func (r *ValkeyAdapter) DeadLetter(topic string, id string) (DeadLetter, error) {
+
+	cmd := r.rc.B().Xrange().Key(deadLetterKey(topic)).Start(id).End(id).Build()
+	entries, err := r.rc.Do(context.Background(), cmd).AsXRange()
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	if len(entries) == 0 {
+		return DeadLetter{}, fmt.Errorf("dead letter %s not found", id)
+	}
+	return entryToDeadLetter(topic, entries[0]), nil
+}
+
+// RequeueDeadLetters deliver the dead letters again and remove them from the dead letter queue
+// Dead letters are pushed to the queue of the subscriber group rejected them (only this group gets the message), the
+// queue is kept while the group has no members. Dead letters of subscription without name can't be requeued
+func (r *ValkeyAdapter) RequeueDeadLetters(topic string, ids ...string) error {
+	return r.requeueDeadLetters(topic, ids, func(letter DeadLetter) error {
+
+		if len(letter.Subscriber) == 0 {
+			return fmt.Errorf("dead letter %s of subscription without name can't be requeued", letter.Id)
+		}
+		cmd := r.rc.B().Lpush().Key(groupQueueKey(topic, letter.Subscriber)).Element(string(letter.Payload)).Build()
+		return r.rc.Do(context.Background(), cmd).Error()
+	})
+}
+
+// RequeueDeadLetters deliver the dead letters again and remove them from the dead letter queue
+// Dead letters are appended to the retry stream of the consumer group rejected them (only this group gets the message),
+// the retry stream and its consumer group are created if they don't exist
+func (r *ValkeyStreamBus) RequeueDeadLetters(topic string, ids ...string) error {
+	return r.requeueDeadLetters(topic, ids, func(letter DeadLetter) error {
+
+		if len(letter.Subscriber) == 0 {
+			return fmt.Errorf("dead letter %s without consumer group can't be requeued", letter.Id)
+		}
+		stream := retryStreamKey(topic, letter.Subscriber)
+		cmd := r.rc.B().XgroupCreate().Key(stream).Group(letter.Subscriber).Id("0").Mkstream().Build()
+		if err := r.rc.Do(context.Background(), cmd).Error(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+		cmd = r.rc.B().Xadd().Key(stream).Id("*").FieldValue().FieldValue(streamField, string(letter.Payload)).Build()
+		return r.rc.Do(context.Background(), cmd).Error()
+	})
+}
+
+// PurgeDeadLetters removes all the dead letters of the topic
+func (r *ValkeyAdapter) PurgeDeadLetters(topic string) error {
+	cmd := r.rc.B().Del().Key(deadLetterKey(topic)).Build()
+	return r.rc.Do(context.Background(), cmd).Error()
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// deadLetter moves the raw message to the topic dead letter queue
+func (r *ValkeyAdapter) deadLetter(topic, subscriberName string, raw []byte, attempts int64, reason error) {
+
+	cmd := r.rc.B().Xadd().Key(deadLetterKey(topic)).Id("*").FieldValue().
+		FieldValue("payload", string(raw)).
+		FieldValue("subscriber", subscriberName).
+		FieldValue("attempts", strconv.FormatInt(attempts, 10)).
+		FieldValue("error", reason.Error()).
+		FieldValue("timestamp", strconv.FormatInt(int64(Now()), 10)).
+		Build()
+
+	if err := r.rc.Do(context.Background(), cmd).Error(); err != nil {
+		logger.Error("[%s] error moving message to dead letter queue of %s: %s", subscriberName, topic, err.Error())
+	} else {
+		logger.Warn("[%s] message moved to dead letter queue of %s after %d attempts: %s", subscriberName, topic, attempts, reason.Error())
+	}
+}
+
+// requeueDeadLetters deliver every dead letter using the requeue function and remove it from the dead letter queue
+func (r *ValkeyAdapter) requeueDeadLetters(topic string, ids []string, requeue func(letter DeadLetter) error) error {
+	for _, id := range ids {
+		letter, err := r.DeadLetter(topic, id)
+		if err != nil {
+			return err
+		}
+		// Requeued message starts over the retry policy attempts
+		if len(rawHeader(letter.Payload, HeaderRetryCount)) > 0 {
+			if letter.Payload, err = setRawHeader(letter.Payload, HeaderRetryCount, ""); err != nil {
+				return err
+			}
+		}
+		if err = requeue(letter); err != nil {
+			return err
+		}
+		cmd := r.rc.B().Xdel().Key(deadLetterKey(topic)).Id(id).Build()
+		if err = r.rc.Do(context.Background(), cmd).Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invoke calls the subscription callback, return errRejected if the callback rejected the message or error on panic
+func invoke(callback SubscriptionCallback, message IMessage) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("subscriber panic: %v", p)
+		}
+	}()
+
+	if callback(message) {
+		return nil
+	} else {
+		return errRejected
+	}
+}
+
+// deadLetterKey is the key of the topic dead letter queue
+func deadLetterKey(topic string) string {
+	return fmt.Sprintf("%s:dlq", topic)
+}
+
+// convert dead letter queue entry to dead letter
+func entryToDeadLetter(topic string, entry valkey.XRangeEntry) DeadLetter {
+	attempts, _ := strconv.ParseInt(entry.FieldValues["attempts"], 10, 64)
+	timestamp, _ := strconv.ParseInt(entry.FieldValues["timestamp"], 10, 64)
+	return DeadLetter{
+		Id:         entry.ID,
+		Topic:      topic,
+		Subscriber: entry.FieldValues["subscriber"],
+		Attempts:   attempts,
+		LastError:  entry.FieldValues["error"],
+		Timestamp:  Timestamp(timestamp),
+		Payload:    []byte(entry.FieldValues["payload"]),
+	}
+}
+
+// endregion
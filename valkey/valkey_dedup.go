@@ -0,0 +1,167 @@
+// Deduplication: duplicate messages (e.g. sent again by a retrying producer) are skipped within a time window
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+
+	. "github.com/go-yaaf/yaaf-common/entity"
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// DedupKeyFunc returns the id identifying the message for deduplication, messages without id are not deduplicated
+type DedupKeyFunc func(message IMessage) string
+
+// IDeduplicator is implemented by the Valkey message buses configured with deduplication (WithDeduplication)
+// The id of every message (the session id by default, see WithDedupKey) is recorded by the subscriber before the
+// callback runs, duplicate messages received within the deduplication window are acknowledged and skipped
+type IDeduplicator interface {
+
+	// Duplicates returns the number of duplicate messages skipped by the subscribers of this message bus
+	Duplicates() uint64
+}
+
+// endregion
+
+// region Deduplication actions ----------------------------------------------------------------------------------------
+
+// Duplicates returns the number of duplicate messages skipped by the subscribers of this message bus
+func (r *ValkeyAdapter) Duplicates() uint64 {
+	return r.duplicates.Load()
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// pushDedupSource is the script pushing the message to the queue unless its id was already pushed within the window
+// KEYS[1] - the queue, KEYS[2] - the message id key, ARGV[1] - the raw message, ARGV[2] - window in milliseconds
+const pushDedupSource = `
+if redis.call('SET', KEYS[2], '1', 'NX', 'PX', ARGV[2]) then
+	return redis.call('LPUSH', KEYS[1], ARGV[1])
+end
+return 0
+`
+
+// pushDedupSha is the digest of the push script used to execute it for bulk messages
+var pushDedupSha = scriptSha(pushDedupSource)
+
+// delayedDedupSource is the script scheduling the delayed message unless its id was already pushed within the window
+// KEYS[1] - the delayed sorted set, KEYS[2] - the message id key, ARGV[1] - the sorted set member,
+// ARGV[2] - window in milliseconds, ARGV[3] - the due time in milliseconds
+const delayedDedupSource = `
+if redis.call('SET', KEYS[2], '1', 'NX', 'PX', ARGV[2]) then
+	return redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+end
+return 0
+`
+
+// delayedDedupSha is the digest of the delayed push script used to execute it for bulk messages
+var delayedDedupSha = scriptSha(delayedDedupSource)
+
+// duplicate records the message id for the subscriber, return true if the id was already recorded within the window
+// Messages are processed when the id can't be recorded
+func (r *ValkeyAdapter) duplicate(topic, scope string, message IMessage) bool {
+
+	id := r.config.dedupKey(message)
+	if r.config.dedupWindow <= 0 || len(id) == 0 {
+		return false
+	}
+
+	cmd := r.rc.B().Set().Key(processedKey(topic, scope, id)).Value("1").Nx().Px(r.config.dedupWindow).Build()
+	err := r.rc.Do(context.Background(), cmd).Error()
+	if valkey.IsValkeyNil(err) {
+		r.duplicates.Add(1)
+		logger.Debug("[%s] duplicate message %s from %s skipped", scope, id, topic)
+		return true
+	}
+	if err != nil {
+		logger.Warn("[%s] error recording message %s from %s: %s", scope, id, topic, err.Error())
+	}
+	return false
+}
+
+// release removes the recorded message id of the subscriber, used when the message failed and is not retried so it
+// is processed if delivered again (e.g. requeued from the dead letter queue)
+func (r *ValkeyAdapter) release(topic, scope string, message IMessage) {
+
+	id := r.config.dedupKey(message)
+	if r.config.dedupWindow <= 0 || len(id) == 0 {
+		return
+	}
+
+	cmd := r.rc.B().Del().Key(processedKey(topic, scope, id)).Build()
+	if err := r.rc.Do(context.Background(), cmd).Error(); err != nil {
+		logger.Warn("[%s] error releasing message %s from %s: %s", scope, id, topic, err.Error())
+	}
+}
+
+// addPush adds the push command of the message to the list of the queue (the queue or its priority list) to the batch,
+// when push deduplication is configured the message is pushed by script ignoring messages already pushed to the queue
+// (to any of its lists or delayed) within the window
+func (r *ValkeyAdapter) addPush(b *batch, index int, queue, list string, message IMessage, raw string) {
+	if id := r.pushDedupId(message); len(id) == 0 {
+		b.add(index, r.rc.B().Lpush().Key(list).Element(raw).Build(), list)
+	} else {
+		r.addDedupScript(b, index, pushDedupSha, pushDedupSource, list, pushedKey(queue, id), raw)
+	}
+}
+
+// addDelayedPush adds the command scheduling the message to the queue at the given time to the batch, when push
+// deduplication is configured the message is scheduled by script ignoring messages already pushed to the queue within
+// the window
+func (r *ValkeyAdapter) addDelayedPush(b *batch, index int, queue string, at time.Time, message IMessage, raw string) {
+
+	// The member is prefixed with unique id to keep identical messages scheduled to the same queue
+	key := delayedKey(queue)
+	member := fmt.Sprintf("%s|%s", NanoID(), raw)
+
+	if id := r.pushDedupId(message); len(id) == 0 {
+		b.add(index, r.rc.B().Zadd().Key(key).ScoreMember().ScoreMember(float64(at.UnixMilli()), member).Build(), key)
+	} else {
+		r.addDedupScript(b, index, delayedDedupSha, delayedDedupSource, key, pushedKey(queue, id), member, strconv.FormatInt(at.UnixMilli(), 10))
+	}
+}
+
+// pushDedupId returns the id of the pushed message for deduplication, empty if push deduplication is not configured
+func (r *ValkeyAdapter) pushDedupId(message IMessage) string {
+	if r.config.pushDedupWindow <= 0 {
+		return ""
+	}
+	return r.config.dedupKey(message)
+}
+
+// addDedupScript adds the push deduplication script of the message to the batch, the script arguments are the pushed
+// value, the window and the extra arguments
+func (r *ValkeyAdapter) addDedupScript(b *batch, index int, sha, source, key, idKey, value string, extra ...string) {
+	args := append([]string{value, strconv.FormatInt(r.config.pushDedupWindow.Milliseconds(), 10)}, extra...)
+	evalsha := r.rc.B().Evalsha().Sha1(sha).Numkeys(2).Key(key, idKey).Arg(args...).Build()
+	eval := r.rc.B().Eval().Script(source).Numkeys(2).Key(key, idKey).Arg(args...).Build()
+	b.addScript(index, evalsha, eval, key, idKey)
+}
+
+// processedKey is the key recording the message id processed by the subscriber (in the topic slot)
+func processedKey(topic, scope, id string) string {
+	return fmt.Sprintf("{%s}:processed:%s:%s", topic, scope, id)
+}
+
+// pushedKey is the key recording the message id pushed to the queue (in the queue slot)
+func pushedKey(queue, id string) string {
+	return fmt.Sprintf("{%s}:pushed:%s", queue, id)
+}
+
+// sessionId is the default deduplication key: the message session id
+func sessionId(message IMessage) string {
+	return message.SessionId()
+}
+
+// endregion
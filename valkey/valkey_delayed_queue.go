@@ -0,0 +1,157 @@
+// Delayed queue: messages pushed with a due time become visible to Pop when the time arrives
+//
+
+package facilities
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// schedulerInterval is the interval between checks for due delayed messages of the queues this consumer pops from
+const schedulerInterval = time.Second
+
+// schedulerBatchSize is the maximum number of due messages moved to the queue by a single script execution
+const schedulerBatchSize = 1000
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IDelayedQueue is implemented by the Valkey message buses to push messages which are delivered at a future time
+// Delayed messages are kept in a sorted set (<queue>:delayed) and moved to the queue by the scheduler of the consumers
+// popping from it, due messages become visible to Pop within the scheduler interval (1 second)
+type IDelayedQueue interface {
+
+	// PushDelayed Append one or multiple messages to a queue after the delay expires
+	PushDelayed(delay time.Duration, messages ...IMessage) error
+
+	// PushAt Append one or multiple messages to a queue at the given time
+	PushAt(at time.Time, messages ...IMessage) error
+}
+
+// endregion
+
+// region Delayed queue actions ----------------------------------------------------------------------------------------
+
+// PushDelayed Append one or multiple messages to a queue after the delay expires
+func (r *ValkeyAdapter) PushDelayed(delay time.Duration, messages ...IMessage) error {
+	return r.PushAt(time.Now().Add(delay), messages...)
+}
+
+// PushAt Append one or multiple messages to a queue at the given time
+func (r *ValkeyAdapter) PushAt(at time.Time, messages ...IMessage) error {
+	b := encodeBatch(messages, r.config.injectors, func(b *batch, index int, message IMessage, raw string) {
+		r.addDelayedPush(b, index, message.Topic(), at, message, raw)
+	})
+	return b.exec(r.rc, r.config.atomicBatch)
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// scheduleScript moves the due messages from the delayed sorted set to the queue, the messages are removed from the
+// sorted set and pushed in a single script so a message is never moved by more than one consumer
+// KEYS[1] - delayed sorted set, KEYS[2] - queue, ARGV[1] - maximum number of messages to move
+var scheduleScript = valkey.NewLuaScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, tonumber(ARGV[1]))
+for _, member in ipairs(members) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('LPUSH', KEYS[2], string.sub(member, string.find(member, '|', 1, true) + 1))
+end
+return #members
+`)
+
+// schedule moves the due delayed messages of the queues to the queues
+func (r *ValkeyAdapter) schedule(ctx context.Context, queue ...string) error {
+	for _, q := range queue {
+		keys := []string{delayedKey(q), q}
+		// Queues with names that can't be used as hash tag (e.g. empty name) have no delayed messages in cluster mode
+		if !sameSlot(r.rc, keys...) {
+			continue
+		}
+		for {
+			count, err := scheduleScript.Exec(ctx, r.rc, keys, []string{strconv.Itoa(schedulerBatchSize)}).AsInt64()
+			if err != nil {
+				return err
+			}
+			if count < schedulerBatchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// startScheduler starts (once) the scheduler moving due delayed messages to the queues this consumer pops from,
+// return the queues which were not scheduled before
+func (r *ValkeyAdapter) startScheduler(queue ...string) []string {
+	added := r.registerQueues(queue...)
+	r.scheduler.Do(func() {
+		go r.runScheduler()
+	})
+	return added
+}
+
+// registerQueues adds the queues to the queues this consumer pops from, return the queues which were not registered
+// before (the lock is taken for write only when new queues are added)
+func (r *ValkeyAdapter) registerQueues(queue ...string) []string {
+	r.RLock()
+	added := make([]string, 0, len(queue))
+	for _, q := range queue {
+		if _, ok := r.queues[q]; !ok {
+			added = append(added, q)
+		}
+	}
+	r.RUnlock()
+
+	if len(added) > 0 {
+		r.Lock()
+		for _, q := range added {
+			r.queues[q] = struct{}{}
+		}
+		r.Unlock()
+	}
+	return added
+}
+
+// runScheduler is a function running a loop which periodically moves due delayed messages until the bus is closed
+func (r *ValkeyAdapter) runScheduler() {
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.RLock()
+		queues := make([]string, 0, len(r.queues))
+		for q := range r.queues {
+			queues = append(queues, q)
+		}
+		r.RUnlock()
+
+		if err := r.schedule(r.ctx, queues...); err != nil && r.ctx.Err() == nil {
+			logger.Warn("error moving delayed messages: %s", err.Error())
+		}
+	}
+}
+
+// delayedKey is the key of the sorted set holding the delayed messages of the queue (scored by due time in
+// milliseconds), kept in the queue cluster slot
+func delayedKey(queue string) string {
+	return slotKey(queue, "delayed")
+}
+
+// endregion
@@ -0,0 +1,161 @@
+// Message envelope: wraps the message with headers (metadata) such as trace context and correlation id
+//
+
+package facilities
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/go-yaaf/yaaf-common/entity"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// Well known message headers
+const (
+	HeaderTraceParent   = "traceparent"    // W3C trace context parent
+	HeaderTraceState    = "tracestate"     // W3C trace context vendor specific state
+	HeaderCorrelationId = "correlation-id" // Correlation id of related messages
+	HeaderProducerId    = "producer-id"    // The id of the message producer
+	HeaderContentType   = "content-type"   // The message content type
+	HeaderSchemaVersion = "schema-version" // The message schema version
+	HeaderRetryCount    = "retry-count"    // Number of times the message was retried (set by the retry policy)
+	HeaderExpiresAt     = "expires-at"     // The message expiration time in milliseconds (see IMessageExpiration)
+)
+
+// envelopePrefix is the beginning of every encoded envelope, used to identify messages sent without envelope
+var envelopePrefix = []byte(`{"$envelope":`)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IMessageHeaders is implemented by messages carrying headers, embed MessageHeaders in the message to add headers.
+// The headers are sent in the message envelope and set to the received message
+type IMessageHeaders interface {
+
+	// Headers returns the message headers
+	Headers() map[string]string
+
+	// SetHeaders replaces the message headers
+	SetHeaders(headers map[string]string)
+}
+
+// MessageHeaders implements IMessageHeaders, the headers are not part of the message payload
+type MessageHeaders struct {
+	headers map[string]string
+}
+
+// Headers returns the message headers
+func (h *MessageHeaders) Headers() map[string]string {
+	return h.headers
+}
+
+// SetHeaders replaces the message headers
+func (h *MessageHeaders) SetHeaders(headers map[string]string) {
+	h.headers = headers
+}
+
+// Header returns the value of a single header (empty if not exists)
+func (h *MessageHeaders) Header(key string) string {
+	return h.headers[key]
+}
+
+// SetHeader sets the value of a single header
+func (h *MessageHeaders) SetHeader(key, value string) {
+	if h.headers == nil {
+		h.headers = make(map[string]string)
+	}
+	h.headers[key] = value
+}
+
+// HeaderInjector adds headers to every message sent by the message bus (e.g. trace context of the current span)
+type HeaderInjector func(message IMessage, headers map[string]string)
+
+// envelope is the wire format of a message with headers
+type envelope struct {
+	Version int               `json:"$envelope"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Message json.RawMessage   `json:"message"`
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// convert message to raw data, messages with headers (of the message or added by the injectors) are wrapped by envelope,
+// otherwise the message is sent as is
+func messageToRaw(message IMessage, injectors ...HeaderInjector) ([]byte, error) {
+
+	headers := make(map[string]string)
+	if carrier, ok := message.(IMessageHeaders); ok {
+		for key, value := range carrier.Headers() {
+			headers[key] = value
+		}
+	}
+	for _, inject := range injectors {
+		inject(message, headers)
+	}
+
+	raw, err := Marshal(message)
+	if err != nil || len(headers) == 0 {
+		return raw, err
+	}
+	return json.Marshal(envelope{Version: 1, Headers: headers, Message: raw})
+}
+
+// convert raw data to message, the envelope headers are set to messages implementing IMessageHeaders
+// Raw data without envelope (sent by older producers) is decoded as the message
+func rawToMessage(factory MessageFactory, raw []byte) (IMessage, error) {
+
+	var env envelope
+	if bytes.HasPrefix(raw, envelopePrefix) {
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return nil, err
+		}
+		raw = env.Message
+	}
+
+	message := factory()
+	if err := Unmarshal(raw, &message); err != nil {
+		return nil, err
+	}
+	if carrier, ok := message.(IMessageHeaders); ok && env.Headers != nil {
+		carrier.SetHeaders(env.Headers)
+	}
+	return message, nil
+}
+
+// rawHeader returns the value of the header in the raw message envelope (empty if not exists)
+func rawHeader(raw []byte, key string) string {
+	if !bytes.HasPrefix(raw, envelopePrefix) {
+		return ""
+	}
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return ""
+	}
+	return env.Headers[key]
+}
+
+// setRawHeader sets the header of the raw message (or removes it when the value is empty), raw message without envelope
+// is wrapped by envelope
+func setRawHeader(raw []byte, key, value string) ([]byte, error) {
+
+	env := envelope{Version: 1, Message: raw}
+	if bytes.HasPrefix(raw, envelopePrefix) {
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return nil, err
+		}
+	}
+	if env.Headers == nil {
+		env.Headers = make(map[string]string)
+	}
+
+	if len(value) > 0 {
+		env.Headers[key] = value
+	} else {
+		delete(env.Headers, key)
+	}
+	return json.Marshal(env)
+}
+
+// endregion
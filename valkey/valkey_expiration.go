@@ -0,0 +1,121 @@
+// Message expiration: messages sent with time to live are discarded by the consumers once they expire
+//
+
+package facilities
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// errExpired is returned by the pop actions when the popped message expired and was discarded
+var errExpired = fmt.Errorf("message expired")
+
+// expiresAtField is the header field of the expiration time in the raw envelope, used to skip decoding of messages
+// without expiration
+var expiresAtField = []byte(`"` + HeaderExpiresAt + `"`)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IMessageExpiration is implemented by the Valkey message buses to send messages with time to live
+// The expiration time is carried in the message header (HeaderExpiresAt), expired messages are discarded by Pop, the
+// consumers and the subscribers without being delivered, or moved to the expired sink queue (see WithExpiredSink)
+type IMessageExpiration interface {
+
+	// PublishWithTTL publish messages which expire after the given time to live
+	PublishWithTTL(ttl time.Duration, messages ...IMessage) error
+
+	// PushWithTTL Append one or multiple messages to a queue, the messages expire after the given time to live
+	PushWithTTL(ttl time.Duration, messages ...IMessage) error
+
+	// Expired returns the number of expired messages discarded by this message bus
+	Expired() uint64
+}
+
+// endregion
+
+// region Message expiration actions -----------------------------------------------------------------------------------
+
+// PublishWithTTL publish messages which expire after the given time to live
+func (r *ValkeyAdapter) PublishWithTTL(ttl time.Duration, messages ...IMessage) error {
+	return publish(r.rc, r.expiringConfig(ttl), messages...)
+}
+
+// PublishWithTTL publish messages to their streams, the messages expire after the given time to live
+func (r *ValkeyStreamBus) PublishWithTTL(ttl time.Duration, messages ...IMessage) error {
+	return streamPublish(r.rc, r.expiringConfig(ttl), messages...)
+}
+
+// PushWithTTL Append one or multiple messages to a queue, the messages expire after the given time to live
+func (r *ValkeyAdapter) PushWithTTL(ttl time.Duration, messages ...IMessage) error {
+	return r.push(r.expiringConfig(ttl), messages...)
+}
+
+// Expired returns the number of expired messages discarded by this message bus
+func (r *ValkeyAdapter) Expired() uint64 {
+	return r.expired.Load()
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// expiringConfig returns the message bus configuration setting the expiration of every message to the time to live
+func (r *ValkeyAdapter) expiringConfig(ttl time.Duration) busConfig {
+	config := r.config
+	config.injectors = append(append([]HeaderInjector{}, r.config.injectors...), expiration(ttl, true))
+	return config
+}
+
+// expiration returns header injector setting the expiration time of the message, existing expiration time is kept
+// unless override is set
+func expiration(ttl time.Duration, override bool) HeaderInjector {
+	return func(message IMessage, headers map[string]string) {
+		if _, ok := headers[HeaderExpiresAt]; ok && !override {
+			return
+		}
+		headers[HeaderExpiresAt] = strconv.FormatInt(time.Now().Add(ttl).UnixMilli(), 10)
+	}
+}
+
+// isExpired checks if the expiration time of the raw message passed, messages without expiration never expire
+func isExpired(raw []byte) bool {
+	if !bytes.Contains(raw, expiresAtField) {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(rawHeader(raw, HeaderExpiresAt), 10, 64)
+	return err == nil && expiresAt <= time.Now().UnixMilli()
+}
+
+// discardExpired checks if the raw message taken from the topic (or queue) expired, the expired message is counted and
+// moved to the expired sink queue (when configured) without its expiration time
+func (r *ValkeyAdapter) discardExpired(topic string, raw []byte) bool {
+
+	if !isExpired(raw) {
+		return false
+	}
+	r.expired.Add(1)
+
+	if len(r.config.expiredSink) == 0 {
+		logger.Debug("expired message from %s discarded", topic)
+		return true
+	}
+
+	// The expiration time is removed to let the sink consumers process the message
+	raw, err := setRawHeader(raw, HeaderExpiresAt, "")
+	if err == nil {
+		err = r.rc.Do(context.Background(), r.rc.B().Lpush().Key(r.config.expiredSink).Element(string(raw)).Build()).Error()
+	}
+	if err != nil {
+		logger.Warn("error moving expired message from %s to %s: %s", topic, r.config.expiredSink, err.Error())
+	}
+	return true
+}
+
+// endregion
@@ -0,0 +1,239 @@
+// Introspection: active channels, topic subscribers and the subscriptions of the message bus
+//
+
+package facilities
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/go-yaaf/yaaf-common/entity"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IBusInspector is implemented by the Valkey message buses to inspect the topics and subscriptions
+// In cluster mode the channels and subscribers of all the cluster nodes are collected
+type IBusInspector interface {
+
+	// Channels lists the active channels (having at least one subscriber) matching the pattern (all if empty), in
+	// sharded mode the shard channels are listed
+	Channels(pattern string) ([]string, error)
+
+	// Patterns returns the number of pattern subscriptions
+	Patterns() (int64, error)
+
+	// Topics returns the subscribers information of the topics
+	Topics(topics ...string) ([]TopicInfo, error)
+
+	// Subscriptions lists the subscriptions of this message bus instance
+	Subscriptions() []SubscriptionInfo
+}
+
+// TopicInfo is the subscribers information of a topic
+type TopicInfo struct {
+	Topic       string   `json:"topic"`       // Topic name
+	Subscribers int64    `json:"subscribers"` // Number of channel subscribers (or stream consumers) of the topic
+	Groups      []string `json:"groups"`      // The live subscriber groups (or stream consumer groups) of the topic
+}
+
+// SubscriptionInfo is the state of a subscription of the message bus
+type SubscriptionInfo struct {
+	Id        string    `json:"id"`        // Subscription id
+	Name      string    `json:"name"`      // Subscriber name
+	Topics    []string  `json:"topics"`    // Exact topics
+	Patterns  []string  `json:"patterns"`  // Pattern topics
+	Group     bool      `json:"group"`     // The subscriber is member of subscriber group
+	Started   Timestamp `json:"started"`   // The time the subscription started
+	Received  uint64    `json:"received"`  // Number of messages received (including redeliveries)
+	Processed uint64    `json:"processed"` // Number of messages processed successfully by the callback
+	Failed    uint64    `json:"failed"`    // Number of messages rejected or failed by the callback
+	Dropped   uint64    `json:"dropped"`   // Number of messages dropped due to subscription buffer overflow
+	Expired   uint64    `json:"expired"`   // Number of expired messages discarded
+}
+
+// subscriptionStats are the message counters of a subscription
+type subscriptionStats struct {
+	received  atomic.Uint64
+	processed atomic.Uint64
+	failed    atomic.Uint64
+	expired   atomic.Uint64
+}
+
+// endregion
+
+// region Inspector actions --------------------------------------------------------------------------------------------
+
+// Channels lists the active channels (having at least one subscriber) matching the pattern (all if empty), in
+// sharded mode the shard channels are listed
+func (r *ValkeyAdapter) Channels(pattern string) ([]string, error) {
+
+	if len(pattern) == 0 {
+		pattern = "*"
+	}
+
+	channels := make(map[string]struct{})
+	for _, node := range r.rc.Nodes() {
+		cmd := node.B().PubsubChannels().Pattern(pattern).Build()
+		if r.config.sharded {
+			cmd = node.B().PubsubShardchannels().Pattern(pattern).Build()
+		}
+		list, err := node.Do(context.Background(), cmd).AsStrSlice()
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range list {
+			channels[channel] = struct{}{}
+		}
+	}
+
+	result := make([]string, 0, len(channels))
+	for channel := range channels {
+		result = append(result, channel)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Patterns returns the number of pattern subscriptions
+func (r *ValkeyAdapter) Patterns() (int64, error) {
+
+	total := int64(0)
+	for _, node := range r.rc.Nodes() {
+		count, err := node.Do(context.Background(), node.B().PubsubNumpat().Build()).AsInt64()
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// Topics returns the subscribers information of the topics: the number of channel subscribers (not including pattern
+// subscribers) and the live subscriber groups
+func (r *ValkeyAdapter) Topics(topics ...string) ([]TopicInfo, error) {
+
+	result := make([]TopicInfo, len(topics))
+	for i, topic := range topics {
+		result[i] = TopicInfo{Topic: topic, Groups: make([]string, 0)}
+	}
+	if len(topics) == 0 {
+		return result, nil
+	}
+
+	for _, node := range r.rc.Nodes() {
+		cmd := node.B().PubsubNumsub().Channel(topics...).Build()
+		if r.config.sharded {
+			cmd = node.B().PubsubShardnumsub().Channel(topics...).Build()
+		}
+		counts, err := node.Do(context.Background(), cmd).AsIntMap()
+		if err != nil {
+			return nil, err
+		}
+		for i := range result {
+			result[i].Subscribers += counts[result[i].Topic]
+		}
+	}
+
+	// Subscriber groups receive messages from the group queue as long as their registration is not expired
+	now := time.Now().UnixMilli()
+	for i := range result {
+		groups, err := r.rc.Do(context.Background(), r.rc.B().Hgetall().Key(groupsKey(result[i].Topic)).Build()).AsStrMap()
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range groups {
+			if deadline, _ := strconv.ParseInt(value, 10, 64); deadline >= now {
+				result[i].Groups = append(result[i].Groups, name)
+			}
+		}
+		sort.Strings(result[i].Groups)
+	}
+	return result, nil
+}
+
+// Topics returns the subscribers information of the stream topics: the number of consumers of all the consumer groups
+// and the consumer groups names
+func (r *ValkeyStreamBus) Topics(topics ...string) ([]TopicInfo, error) {
+
+	result := make([]TopicInfo, len(topics))
+	for i, topic := range topics {
+		result[i] = TopicInfo{Topic: topic, Groups: make([]string, 0)}
+
+		groups, err := r.rc.Do(context.Background(), r.rc.B().XinfoGroups().Key(topic).Build()).ToArray()
+		if err != nil {
+			// The stream does not exist, there are no consumer groups
+			if strings.Contains(err.Error(), "no such key") {
+				continue
+			}
+			return nil, err
+		}
+		for _, group := range groups {
+			fields, er := group.AsMap()
+			if er != nil {
+				return nil, er
+			}
+			nameField, consumersField := fields["name"], fields["consumers"]
+			name, _ := nameField.ToString()
+			consumers, _ := consumersField.AsInt64()
+			result[i].Groups = append(result[i].Groups, name)
+			result[i].Subscribers += consumers
+		}
+	}
+	return result, nil
+}
+
+// Subscriptions lists the subscriptions of this message bus instance
+func (r *ValkeyAdapter) Subscriptions() []SubscriptionInfo {
+	r.RLock()
+	defer r.RUnlock()
+
+	result := make([]SubscriptionInfo, 0, len(r.subs))
+	for id, sub := range r.subs {
+		info := SubscriptionInfo{
+			Id:        id,
+			Name:      sub.name,
+			Topics:    sub.topics,
+			Patterns:  sub.patterns,
+			Group:     sub.group,
+			Started:   Timestamp(sub.started.UnixMilli()),
+			Received:  sub.stats.received.Load(),
+			Processed: sub.stats.processed.Load(),
+			Failed:    sub.stats.failed.Load(),
+			Expired:   sub.stats.expired.Load(),
+		}
+		if sub.pool != nil {
+			info.Dropped = sub.pool.dropped.Load()
+		}
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Started < result[j].Started })
+	return result
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// track wraps the subscription callback to count the processed and failed messages (a callback panic is counted as
+// failure and propagated)
+func (s *subscriber) track(callback SubscriptionCallback) SubscriptionCallback {
+	return func(message IMessage) (ok bool) {
+		defer func() {
+			if ok {
+				s.stats.processed.Add(1)
+			} else {
+				s.stats.failed.Add(1)
+			}
+		}()
+		return callback(message)
+	}
+}
+
+// endregion
@@ -0,0 +1,159 @@
+// Keyspace notifications: watch changes and expiration of cached keys
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/valkey-io/valkey-go"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+)
+
+// KeyEvent is the type of operation performed on a key, as published by the keyspace notifications
+type KeyEvent string
+
+// Common key events (see the Valkey keyspace notifications documentation for the full list)
+const (
+	KeyEventSet        KeyEvent = "set"
+	KeyEventDel        KeyEvent = "del"
+	KeyEventExpire     KeyEvent = "expire"
+	KeyEventExpired    KeyEvent = "expired"
+	KeyEventEvicted    KeyEvent = "evicted"
+	KeyEventRenameFrom KeyEvent = "rename_from"
+	KeyEventRenameTo   KeyEvent = "rename_to"
+	KeyEventNew        KeyEvent = "new"
+	KeyEventLPush      KeyEvent = "lpush"
+	KeyEventRPush      KeyEvent = "rpush"
+	KeyEventHSet       KeyEvent = "hset"
+	KeyEventHDel       KeyEvent = "hdel"
+)
+
+// keyspaceEventsFlags are the notify-keyspace-events flags required by Watch: keyspace channel (K) of all events (A)
+const keyspaceEventsFlags = "KA"
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// KeyspaceEvent is a notification of an operation performed on a key
+type KeyspaceEvent struct {
+	Db    int      `json:"db"`    // Database number
+	Key   string   `json:"key"`   // The key name
+	Event KeyEvent `json:"event"` // The operation performed on the key
+}
+
+// KeyspaceCallback is the function called for every keyspace event
+type KeyspaceCallback func(event KeyspaceEvent)
+
+// IKeyspaceWatcher is implemented by the Valkey data cache to watch keyspace notifications
+// Notifications must be enabled on the server (notify-keyspace-events), either by the server configuration or using
+// EnableKeyspaceEvents. In cluster mode notifications are published only to the clients connected to the node which
+// owns the key
+type IKeyspaceWatcher interface {
+
+	// Watch keys matching the pattern (glob-style) for the events (all events if empty), the returned handle stops
+	// watching when closed
+	Watch(pattern string, events []KeyEvent, callback KeyspaceCallback) (io.Closer, error)
+
+	// EnableKeyspaceEvents enables the keyspace notifications required by Watch (when allowed by the server)
+	EnableKeyspaceEvents() error
+}
+
+// endregion
+
+// region Keyspace actions ---------------------------------------------------------------------------------------------
+
+// Watch keys matching the pattern (glob-style) for the events (all events if empty), the returned handle stops
+// watching when closed. Events are processed using the subscription defaults of the message bus (see
+// WithSubscriptionDefaults), use WithOrdered to process the events in order
+func (r *ValkeyAdapter) Watch(pattern string, events []KeyEvent, callback KeyspaceCallback) (io.Closer, error) {
+
+	if callback == nil {
+		return nil, fmt.Errorf("callback is nil")
+	}
+
+	db := 0
+	if options, err := valkey.ParseURL(r.uri); err == nil {
+		db = options.SelectDB
+	}
+
+	filter := make(map[KeyEvent]bool)
+	for _, event := range events {
+		filter[event] = true
+	}
+
+	// The keyspace channel is __keyspace@<db>__:<key> and the message is the event
+	prefix := fmt.Sprintf("__keyspace@%d__:", db)
+	sub := &subscriber{
+		name:     fmt.Sprintf("watch:%s", pattern),
+		patterns: []string{prefix + pattern},
+		done:     make(chan struct{}),
+	}
+
+	// Events are buffered and processed by the worker pool using the subscription defaults of the message bus
+	pool := newWorkerPool(sub.name, newSubscriptionConfig(r.config.subscription...), sub.done)
+	sub.pool = pool
+	sub.notify = func(channel string, payload string) {
+		event := KeyspaceEvent{Db: db, Key: strings.TrimPrefix(channel, prefix), Event: KeyEvent(payload)}
+		if len(filter) > 0 && !filter[event.Event] {
+			return
+		}
+		pool.submit(sub.ctx, func() {
+			defer func() {
+				if p := recover(); p != nil {
+					sub.stats.failed.Add(1)
+					logger.Error("[%s] watch callback panic: %v", sub.name, p)
+				}
+			}()
+			callback(event)
+			sub.stats.processed.Add(1)
+		}, nil)
+	}
+
+	if subscriptionId, err := r.subscribe(sub); err != nil {
+		return nil, err
+	} else {
+		pool.start()
+		return &keyspaceWatch{bus: r, subscriptionId: subscriptionId}, nil
+	}
+}
+
+// EnableKeyspaceEvents enables the keyspace notifications required by Watch (when allowed by the server), the
+// notification flags already configured are kept
+func (r *ValkeyAdapter) EnableKeyspaceEvents() error {
+
+	values, err := r.rc.Do(context.Background(), r.rc.B().ConfigGet().Parameter("notify-keyspace-events").Build()).AsStrMap()
+	if err != nil {
+		return err
+	}
+
+	flags := values["notify-keyspace-events"]
+	for _, flag := range keyspaceEventsFlags {
+		if !strings.ContainsRune(flags, flag) {
+			flags += string(flag)
+		}
+	}
+
+	cmd := r.rc.B().ConfigSet().ParameterValue().ParameterValue("notify-keyspace-events", flags).Build()
+	return r.rc.Do(context.Background(), cmd).Error()
+}
+
+// endregion
+
+// region Watch handle -------------------------------------------------------------------------------------------------
+
+type keyspaceWatch struct {
+	bus            *ValkeyAdapter
+	subscriptionId string
+}
+
+// Close stops watching the keys
+func (w *keyspaceWatch) Close() error {
+	w.bus.Unsubscribe(w.subscriptionId)
+	return nil
+}
+
+// endregion
@@ -6,131 +6,596 @@ package facilities
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/valkey-io/valkey-go"
 
 	. "github.com/go-yaaf/yaaf-common/entity"
+	"github.com/go-yaaf/yaaf-common/logger"
 	. "github.com/go-yaaf/yaaf-common/messaging"
 )
 
+// IMessageQueue is implemented by the Valkey message buses to extend the IMessageBus queue actions
+type IMessageQueue interface {
+
+	// PopFrom Remove and get the last message in one of the queues or block until timeout expires or the context is
+	// canceled, return the queue the message was taken from
+	PopFrom(ctx context.Context, factory MessageFactory, timeout time.Duration, queue ...string) (string, IMessage, error)
+}
+
+// consumerBufferSize is the maximum number of messages buffered by a consumer until they are read
+const consumerBufferSize = 1000
+
+// groupTTL is the time a subscriber group stays registered on a topic without being refreshed by any of its members
+const groupTTL = time.Second * 30
+
+// pollInterval is the interval between pop attempts when blocking on queues which can't be popped by a single command
+const pollInterval = time.Millisecond * 100
+
+// topicSpecialChars are the glob-style pattern characters which are escaped in exact topics
+const topicSpecialChars = "*?[]\\"
+
+// unsubscribeTimeout is the maximum time to wait for the server to confirm the unsubscribe of a subscription
+const unsubscribeTimeout = time.Second * 5
+
+// groupBlockTime is the maximum time a group reader blocks on the group queue before checking for cancellation
+const groupBlockTime = time.Second
+
 // region Message Bus actions ------------------------------------------------------------------------------------------
 
-// Publish messages to a channel (topic)
+// Publish messages to a channel (topic), the message is also queued for every subscriber group of the topic
+// All the messages are sent in a single round trip, BatchError reports the messages which were not accepted
 func (r *ValkeyAdapter) Publish(messages ...IMessage) error {
-	for _, message := range messages {
-		if bytes, err := messageToRaw(message); err != nil {
-			return err
-		} else {
-			cmd := r.rc.B().Publish().Channel(message.Topic()).Message(string(bytes)).Build()
-			res := r.rc.Do(context.Background(), cmd)
-			if res.Error() != nil {
-				return res.Error()
-			}
-		}
-	}
-	return nil
+	return publish(r.rc, r.config, messages...)
 }
 
 // Subscribe on topics
+// Subscribers sharing the same name on the same topics are competing consumers: each message is delivered to
+// exactly one of them. Subscribers with different names get every message. Subscription without a name is delivered
+// to every subscriber using pub/sub.
+// Topics including glob-style characters (*, ? or [...]) are patterns, pattern topics can be subscribed only without
+// a name, use EscapeTopic for exact topic including them
 func (r *ValkeyAdapter) Subscribe(subscriberName string, factory MessageFactory, callback SubscriptionCallback, topics ...string) (string, error) {
+	return r.SubscribeWith(subscriberName, factory, callback, nil, topics...)
+}
+
+// SubscribeWith subscribe on topics with the subscription options (concurrency, ordering and buffering), the options
+// override the subscription defaults of the message bus
+func (r *ValkeyAdapter) SubscribeWith(subscriberName string, factory MessageFactory, callback SubscriptionCallback, options []SubscriptionOption, topics ...string) (string, error) {
+
+	// Validate callback
+	if callback == nil {
+		return "", fmt.Errorf("callback is nil")
+	}
+
+	sub := newSubscriber(subscriberName, factory, topics...)
+	group := len(subscriberName) > 0
+
+	// Subscriber group queues are created per topic when the message is published, patterns have no queue
+	if group && len(sub.patterns) > 0 {
+		return "", fmt.Errorf("subscriber group %s can't subscribe on pattern topics: %s", subscriberName, strings.Join(sub.patterns, ", "))
+	}
+
+	// Retries are scheduled in Valkey and pushed to the group queue, other subscriptions have no queue to retry from
+	if r.config.retry.enabled() && !group {
+		return "", fmt.Errorf("retry policy requires subscriber group: subscription without name can't be retried")
+	}
+	callback = sub.track(callback)
+
+	// Messages are buffered and processed by bounded number of workers until the subscription is done
+	config := newSubscriptionConfig(append(append([]SubscriptionOption{}, r.config.subscription...), options...)...)
+	pool := newWorkerPool(subscriberName, config, sub.done)
+	sub.pool = pool
+	sub.deliver = func(topic string, raw []byte, message IMessage) {
+		pool.submit(sub.ctx, func() {
+			r.handle(sub, topic, raw, message, callback)
+		}, r.undelivered(sub, topic, raw))
+	}
+
+	var subscriptionId string
+	var err error
+	if group {
+		subscriptionId, err = r.subscribeGroup(sub)
+	} else {
+		subscriptionId, err = r.subscribe(sub)
+	}
+	if err == nil {
+		pool.start()
+	}
+	return subscriptionId, err
+}
 
-	topicArray := make([]string, 0)
+// newSubscriber creates subscription state for the topics, each topic is classified as exact topic or pattern
+func newSubscriber(name string, factory MessageFactory, topics ...string) *subscriber {
+
+	exact := make([]string, 0)
+	patterns := make([]string, 0)
 
-	// Check if topics include * - in this case it should be patterned subscribe
-	isPattern := false
 	for _, t := range topics {
-		if strings.Contains(t, "*") {
-			isPattern = true
+		if isPatternTopic(t) {
+			patterns = append(patterns, t)
+		} else {
+			exact = append(exact, unescapeTopic(t))
 		}
-		topicArray = append(topicArray, t)
 	}
 
-	var ps *valkey.PubSubHooks
+	// Subscriptions without name don't share the recorded message ids
+	scope := name
+	if len(scope) == 0 {
+		scope = NanoID()
+	}
 
-	if isPattern {
-		cmd := r.rc.B().Psubscribe().Pattern(topics...).Build()
-		res := r.rc.Do(context.Background(), cmd)
-		if res.Error() != nil {
-			return "", res.Error()
+	return &subscriber{
+		name:     name,
+		factory:  factory,
+		topics:   exact,
+		patterns: patterns,
+		scope:    scope,
+		done:     make(chan struct{}),
+	}
+}
+
+// subscribe starts the receive loop of the subscription and register it, return the subscription id
+// In sharded mode every topic is received on a dedicated connection to the node owning the topic slot
+func (r *ValkeyAdapter) subscribe(sub *subscriber) (string, error) {
+
+	if len(sub.topics)+len(sub.patterns) == 0 {
+		return "", fmt.Errorf("no topics to subscribe")
+	}
+
+	// Exact topics and patterns are received on the same connection
+	channels := []receiveChannels{{topics: sub.topics, patterns: sub.patterns}}
+	if r.config.sharded {
+		if len(sub.patterns) > 0 {
+			return "", fmt.Errorf("pattern topics are not supported in sharded pub/sub mode")
 		}
+		channels = make([]receiveChannels, 0, len(sub.topics))
+		for _, topic := range sub.topics {
+			channels = append(channels, receiveChannels{topics: []string{topic}})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	sub.ctx, sub.cancel = ctx, cancel
+
+	// The subscription is done when all the receive loops are done
+	wg := &sync.WaitGroup{}
+	defer func() {
+		go func() {
+			wg.Wait()
+			close(sub.done)
+		}()
+	}()
+
+	for _, ch := range channels {
+		moved := make(chan struct{}, 1)
+		dc, release, wait, err := r.receive(ctx, sub, ch, moved)
+		if err != nil {
+			cancel()
+			return "", err
+		}
+		wg.Add(1)
+		go func(ch receiveChannels) {
+			defer wg.Done()
+			r.subscriber(ctx, sub, ch, moved, dc, release, wait)
+		}(ch)
+	}
+
+	subscriptionId := NanoID()
+
+	r.Lock()
+	defer r.Unlock()
+	sub.started = time.Now()
+	r.subs[subscriptionId] = sub
+	return subscriptionId, nil
+}
+
+// receive dedicates a connection to the subscription channels, registers the message hooks and subscribes to the topics
+// and patterns. The moved channel is signaled when the server unsubscribes a sharded topic due to slot migration
+func (r *ValkeyAdapter) receive(ctx context.Context, sub *subscriber, ch receiveChannels, moved chan struct{}) (valkey.DedicatedClient, func(), <-chan error, error) {
+
+	dc, release := r.rc.Dedicate()
+
+	wait := dc.SetPubSubHooks(valkey.PubSubHooks{
+		OnMessage: func(m valkey.PubSubMessage) {
+			// Notifications (e.g. keyspace events) are not messages, they are delivered without decoding
+			if sub.notify != nil {
+				sub.stats.received.Add(1)
+				sub.notify(m.Channel, m.Message)
+			} else {
+				r.dispatch(sub, m.Channel, []byte(m.Message))
+			}
+		},
+		OnSubscription: func(s valkey.PubSubSubscription) {
+			if s.Kind == "sunsubscribe" && ctx.Err() == nil {
+				select {
+				case moved <- struct{}{}:
+				default:
+				}
+			}
+		},
+	})
+
+	cmds := make(valkey.Commands, 0, 2)
+	if r.config.sharded {
+		cmds = append(cmds, dc.B().Ssubscribe().Channel(ch.topics...).Build())
 	} else {
-		cmd := r.rc.B().Subscribe().Channel(topics...).Build()
-		res := r.rc.Do(context.Background(), cmd)
-		if res.Error() != nil {
-			return "", res.Error()
+		if len(ch.topics) > 0 {
+			cmds = append(cmds, dc.B().Subscribe().Channel(ch.topics...).Build())
+		}
+		if len(ch.patterns) > 0 {
+			cmds = append(cmds, dc.B().Psubscribe().Pattern(ch.patterns...).Build())
 		}
 	}
+	for _, res := range dc.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+	}
+	return dc, release, wait, nil
+}
+
+// subscriber is a function running a loop which keeps the subscription of the channels alive until it is canceled
+func (r *ValkeyAdapter) subscriber(ctx context.Context, sub *subscriber, ch receiveChannels, moved chan struct{}, dc valkey.DedicatedClient, release func(), wait <-chan error) {
+
+	for {
+		delay := time.Second
+
+		select {
+		case <-ctx.Done():
+			cmds := make(valkey.Commands, 0, 2)
+			if r.config.sharded {
+				cmds = append(cmds, dc.B().Sunsubscribe().Channel(ch.topics...).Build())
+			} else {
+				if len(ch.topics) > 0 {
+					cmds = append(cmds, dc.B().Unsubscribe().Channel(ch.topics...).Build())
+				}
+				if len(ch.patterns) > 0 {
+					cmds = append(cmds, dc.B().Punsubscribe().Pattern(ch.patterns...).Build())
+				}
+			}
+			// The unsubscribe is bounded since the reply is not read while a message hook is blocked
+			uctx, ucancel := context.WithTimeout(context.Background(), unsubscribeTimeout)
+			for _, res := range dc.DoMulti(uctx, cmds...) {
+				if err := res.Error(); err != nil {
+					logger.Warn("[%s] error unsubscribing: %s", sub.name, err.Error())
+				}
+			}
+			ucancel()
+			release()
+			return
+		case <-moved:
+			// The topic slot was migrated, subscribe again on a connection to the new slot owner
+			release()
+			logger.Debug("[%s] sharded topics %v moved, resubscribing", sub.name, ch.topics)
+			delay = 0
+		case err := <-wait:
+			// The connection is broken, release it and subscribe again on a new one
+			release()
+			if err != nil {
+				logger.Warn("[%s] subscription connection lost: %s", sub.name, err.Error())
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			var err error
+			if dc, release, wait, err = r.receive(ctx, sub, ch, moved); err == nil {
+				break
+			}
+			logger.Warn("[%s] error resubscribing: %s", sub.name, err.Error())
+			delay = time.Second
+		}
+	}
+}
+
+// subscribeGroup registers the subscriber group on the topics and starts reading the group queues
+func (r *ValkeyAdapter) subscribeGroup(sub *subscriber) (string, error) {
+
+	if len(sub.topics) == 0 {
+		return "", fmt.Errorf("no topics to subscribe")
+	}
+	if err := r.registerGroup(sub); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	sub.ctx, sub.cancel = ctx, cancel
+	sub.group = true
 
 	subscriptionId := NanoID()
 
 	r.Lock()
 	defer r.Unlock()
-	r.subs[subscriptionId] = subscriber{ps: ps, topics: topicArray}
-	go r.subscriber(ps, callback, factory)
+	sub.started = time.Now()
+	r.subs[subscriptionId] = sub
+	go r.groupSubscriber(ctx, sub)
 	return subscriptionId, nil
 }
 
-// subscriber is a function running infinite loop to get messages from channel
-func (r *ValkeyAdapter) subscriber(ps *valkey.PubSubHooks, callback SubscriptionCallback, factory MessageFactory) {
+// registerGroup sets (or refresh) the subscriber group registration and this message bus group membership on the topics
+// until groupTTL expires, the group queue is kept while the group is registered
+func (r *ValkeyAdapter) registerGroup(sub *subscriber) error {
+
+	deadline := fmt.Sprintf("%d", time.Now().Add(groupTTL).UnixMilli())
+
+	cmds := make(valkey.Commands, 0, len(sub.topics)*3)
+	for _, topic := range sub.topics {
+		cmds = append(cmds, r.rc.B().Hset().Key(groupsKey(topic)).FieldValue().FieldValue(sub.name, deadline).Build())
+		cmds = append(cmds, r.rc.B().Hset().Key(membersKey(topic, sub.name)).FieldValue().FieldValue(r.consumerId, deadline).Build())
+		cmds = append(cmds, r.rc.B().Persist().Key(groupQueueKey(topic, sub.name)).Build())
+	}
+	for _, res := range r.rc.DoMulti(r.ctx, cmds...) {
+		if res.Error() != nil {
+			return res.Error()
+		}
+	}
+	return nil
+}
+
+// groupSubscriber is a function running a reader per topic group queue and keeps the group registered until it is canceled
+func (r *ValkeyAdapter) groupSubscriber(ctx context.Context, sub *subscriber) {
+
+	defer close(sub.done)
+
+	wg := &sync.WaitGroup{}
+	for _, topic := range sub.topics {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			r.groupReader(ctx, sub, topic)
+		}(topic)
+	}
+
+	// Due retries are moved to the group queues
+	if r.config.retry.enabled() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.retryScheduler(ctx, sub, func(topic string) string { return groupQueueKey(topic, sub.name) }, "list")
+		}()
+	}
+
+	ticker := time.NewTicker(groupTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The messages popped from the group queues and not processed are returned to the queues
+			wg.Wait()
+			if sub.pool != nil {
+				sub.pool.drain()
+			}
+			r.unregisterGroup(sub)
+			return
+		case <-ticker.C:
+			if err := r.registerGroup(sub); err != nil {
+				logger.Warn("[%s] error refreshing subscriber group: %s", sub.name, err.Error())
+			}
+		}
+	}
+}
+
+// unregisterGroup removes this message bus group membership on the topics which have no other local member of the
+// group, the group registration is removed when the group has no other live member and its queue expires after groupTTL
+// unless the group is registered again
+func (r *ValkeyAdapter) unregisterGroup(sub *subscriber) {
+
+	r.RLock()
+	topics := make([]string, 0, len(sub.topics))
+	for _, topic := range sub.topics {
+		if !r.hasGroupMember(sub, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	r.RUnlock()
+
+	ttl := strconv.FormatInt(groupTTL.Milliseconds(), 10)
+	for _, topic := range topics {
+		keys := []string{groupsKey(topic), membersKey(topic, sub.name), groupQueueKey(topic, sub.name)}
+		if err := unregisterScript.Exec(context.Background(), r.rc, keys, []string{sub.name, r.consumerId, ttl}).Error(); err != nil {
+			logger.Warn("[%s] error removing subscriber group from %s: %s", sub.name, topic, err.Error())
+		}
+	}
+}
+
+// hasGroupMember checks if other subscription of this message bus is a member of the subscriber group on the topic
+func (r *ValkeyAdapter) hasGroupMember(sub *subscriber, topic string) bool {
+	for _, other := range r.subs {
+		if other == sub || !other.group || other.name != sub.name {
+			continue
+		}
+		for _, t := range other.topics {
+			if t == topic {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupReader pops messages from the topic group queue until it is canceled
+// The pop is not bound to the context to avoid losing a message popped while the subscription is canceled
+func (r *ValkeyAdapter) groupReader(ctx context.Context, sub *subscriber, topic string) {
+
+	queue := groupQueueKey(topic, sub.name)
+	for ctx.Err() == nil {
+		cmd := r.rc.B().Brpop().Key(queue).Timeout(groupBlockTime.Seconds()).Build()
+		values, err := r.rc.Do(context.Background(), cmd).AsStrSlice()
+		if valkey.IsValkeyNil(err) {
+			continue
+		}
+		if err != nil {
+			logger.Warn("[%s] error reading group queue %s: %s", sub.name, queue, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		r.dispatch(sub, topic, []byte(values[1]))
+	}
+}
+
+// undelivered returns the function pushing the raw message back to the group queue (to be popped next) when it is not
+// processed before the subscription stops, messages of subscriptions which are not subscriber group are not kept
+func (r *ValkeyAdapter) undelivered(sub *subscriber, topic string, raw []byte) func() {
+	if !sub.group {
+		return nil
+	}
+	return func() {
+		cmd := r.rc.B().Rpush().Key(groupQueueKey(topic, sub.name)).Element(string(raw)).Build()
+		if err := r.rc.Do(context.Background(), cmd).Error(); err != nil {
+			logger.Warn("[%s] error returning message to group queue of %s: %s", sub.name, topic, err.Error())
+		}
+	}
+}
+
+// dispatch decodes the raw message and deliver it to the subscriber, messages which can't be decoded are dead-lettered
+// and expired messages are discarded
+func (r *ValkeyAdapter) dispatch(sub *subscriber, topic string, raw []byte) {
+	sub.stats.received.Add(1)
+	if r.discardExpired(topic, raw) {
+		sub.stats.expired.Add(1)
+		return
+	}
+	if message, err := rawToMessage(sub.factory, raw); err != nil {
+		sub.stats.failed.Add(1)
+		logger.Warn("[%s] error decoding message from %s: %s", sub.name, topic, err.Error())
+		if r.config.deadLetterAttempts > 0 {
+			r.deadLetter(topic, sub.name, raw, 0, err)
+		}
+	} else {
+		sub.deliver(topic, raw, message)
+	}
+}
+
+// handle invokes the subscription callback, when dead letter policy is configured the callback is retried with
+// backoff (see deadLetterBackoff) until max attempts and then the message is moved to the topic dead letter queue. A
+// callback panic is not retried, a group message waiting for the next attempt when the subscription stops is returned
+// to the group queue
+// When retry policy is configured, the failed message is delivered again after the retry delay (see retry)
+// When deduplication is configured, duplicate messages are skipped (retries are not checked)
+func (r *ValkeyAdapter) handle(sub *subscriber, topic string, raw []byte, message IMessage, callback SubscriptionCallback) {
+
+	if retryCount(raw) == 0 && r.duplicate(topic, sub.scope, message) {
+		return
+	}
+
+	if r.config.retry.enabled() {
+		r.retry(sub, topic, raw, message, callback)
+		return
+	}
+
+	attempts := int64(0)
+	for {
+		attempts++
+		err := invoke(callback, message)
+		if err == nil {
+			return
+		}
+		if err != errRejected {
+			logger.Error("[%s] error processing message from %s: %s", sub.name, topic, err.Error())
+		}
+		if r.config.deadLetterAttempts <= 0 {
+			r.release(topic, sub.scope, message)
+			return
+		}
+		if err != errRejected || attempts >= r.config.deadLetterAttempts {
+			r.deadLetter(topic, sub.name, raw, attempts, err)
+			r.release(topic, sub.scope, message)
+			return
+		}
+
+		select {
+		case <-sub.ctx.Done():
+			r.release(topic, sub.scope, message)
+			if undelivered := r.undelivered(sub, topic, raw); undelivered != nil {
+				undelivered()
+			}
+			return
+		case <-time.After(deadLetterBackoff.Delay(int(attempts))):
+		}
+	}
+}
+
+// retry invokes the subscription callback and schedules the retry of a failed message until the max attempts of the
+// retry policy. Retries are scheduled in Valkey and pushed to the subscriber group queue when due, a message which
+// retry can't be scheduled is moved to the dead letter queue (when enabled) or dropped
+func (r *ValkeyAdapter) retry(sub *subscriber, topic string, raw []byte, message IMessage, callback SubscriptionCallback) {
+
+	err := invoke(callback, message)
+	if err == nil {
+		return
+	}
+	if err != errRejected {
+		logger.Error("[%s] error processing message from %s: %s", sub.name, topic, err.Error())
+	}
+	if r.exhausted(topic, sub.name, raw, int64(retryCount(raw)+1), err) {
+		r.release(topic, sub.scope, message)
+		return
+	}
 
-	//LOOP:
-	//for {
-	//	select {
-	//	case m := <-ps.make(chan interface {})
-	//		if m == nil {
-	//			break LOOP
-	//		}
-	//		message := factory()
-	//		if err := Unmarshal([]byte(m.Payload), &message); err != nil {
-	//			continue
-	//		} else {
-	//			go callback(message)
-	//		}
-	//	}
-	//}
+	if er := r.scheduleRetry(topic, sub.name, raw); er != nil {
+		logger.Warn("[%s] error scheduling retry of message from %s: %s", sub.name, topic, er.Error())
+		r.giveUp(topic, sub.name, raw, int64(retryCount(raw)+1), er)
+		r.release(topic, sub.scope, message)
+	}
 }
 
 // Unsubscribe with the given subscriber id
 func (r *ValkeyAdapter) Unsubscribe(subscriptionId string) bool {
 	r.Lock()
-	defer r.Unlock()
+	sub, ok := r.subs[subscriptionId]
+	if ok {
+		delete(r.subs, subscriptionId)
+	}
+	r.Unlock()
+
+	if !ok {
+		return false
+	}
 
-	//if v, ok := r.subs[subscriptionId]; !ok {
-	//	return false
-	//} else {
-	//	v.ps.
-	//	if err := v.ps.Unsubscribe(r.ctx, v.topics...); err != nil {
-	//		logger.Warn("Unsubscribe error unsubscribe: %s\n", err.Error())
-	//	}
-	//	if err := v.ps.Close(); err != nil {
-	//		logger.Warn("Unsubscribe error closing PubSub: %s\n", err.Error())
-	//	}
-	//	delete(r.subs, subscriptionId)
-	//	return true
-	//}
+	// Stop the receive loop and wait until the topics are unsubscribed
+	sub.cancel()
+	<-sub.done
 	return true
 }
 
 // Push Append one or multiple messages to a queue
+// All the messages are sent in a single round trip, BatchError reports the messages which were not accepted
 func (r *ValkeyAdapter) Push(messages ...IMessage) error {
-	for _, message := range messages {
-		if bytes, err := messageToRaw(message); err != nil {
-			return err
-		} else {
-			cmd := r.rc.B().Lpush().Key(message.Topic()).Element(string(bytes)).Build()
-			res := r.rc.Do(context.Background(), cmd)
-			if res.Error() != nil {
-				return res.Error()
-			}
-		}
-	}
-	return nil
+	return r.push(r.config, messages...)
+}
+
+// push messages to their queues using the message bus configuration
+func (r *ValkeyAdapter) push(config busConfig, messages ...IMessage) error {
+	b := encodeBatch(messages, config.injectors, func(b *batch, index int, message IMessage, raw string) {
+		r.addPush(b, index, message.Topic(), message.Topic(), message, raw)
+	})
+	return b.exec(r.rc, config.atomicBatch)
 }
 
 // Pop Remove and get the last message in a queue or block until timeout expires
+// In reliable queue mode the message is moved to the consumer processing list until it is acknowledged
 func (r *ValkeyAdapter) Pop(factory MessageFactory, timeout time.Duration, queue ...string) (IMessage, error) {
+	_, message, err := r.PopFrom(r.ctx, factory, timeout, queue...)
+	return message, err
+}
+
+// PopFrom Remove and get the last message in one of the queues (checked in order) or block until timeout expires or the
+// context is canceled, return the queue the message was taken from. ErrNotFound is returned when no message is available
+// Expired messages are discarded and the pop continues until the timeout expires
+func (r *ValkeyAdapter) PopFrom(ctx context.Context, factory MessageFactory, timeout time.Duration, queue ...string) (string, IMessage, error) {
 
 	message := factory()
 
@@ -138,70 +603,284 @@ func (r *ValkeyAdapter) Pop(factory MessageFactory, timeout time.Duration, queue
 		queue = append(queue, message.Topic())
 	}
 
-	if timeout == 0 {
-		cmd := r.rc.B().Rpop().Key(queue[0]).Build()
-		res := r.rc.Do(context.Background(), cmd)
-		if bytes, er := res.AsBytes(); er != nil {
-			return nil, er
-		} else {
-			return rawToMessage(factory, bytes)
+	// Move due delayed messages to the queues popped for the first time, later the scheduler keeps moving them
+	if added := r.startScheduler(queue...); len(added) > 0 {
+		if err := r.schedule(ctx, added...); err != nil {
+			return "", nil, err
 		}
-	} else {
-		cmd := r.rc.B().Brpop().Key(queue...).Timeout(float64(timeout)).Build()
-		res := r.rc.Do(context.Background(), cmd)
-		if bytes, err := res.AsBytes(); err != nil {
-			return nil, err
+	}
+
+	// The priority lists are checked before the queues, from the highest priority
+	keys, source := r.priorityKeys(queue...)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var q string
+		var err error
+		if r.config.processingTimeout > 0 {
+			q, message, err = r.reliablePop(ctx, factory, timeout, source, keys...)
 		} else {
-			return rawToMessage(factory, bytes)
+			var key string
+			key, message, err = r.popKeys(ctx, factory, timeout, keys...)
+			q = source[key]
+		}
+		if err != errExpired {
+			return q, message, err
+		}
+
+		// Blocking pop continues for the rest of the timeout (zero timeout of blocking command blocks forever)
+		if timeout > 0 {
+			if timeout = time.Until(deadline); timeout < time.Millisecond {
+				return "", nil, ErrNotFound
+			}
+		}
+	}
+}
+
+// popKeys removes and get the last message of the first non-empty list or block until timeout expires or the context
+// is canceled, return the list the message was taken from (or errExpired if the message expired)
+func (r *ValkeyAdapter) popKeys(ctx context.Context, factory MessageFactory, timeout time.Duration, queue ...string) (string, IMessage, error) {
+
+	if timeout == 0 {
+		return r.pop(ctx, factory, queue...)
+	}
+
+	// In cluster mode a blocking pop is available only for queues in the same slot, otherwise poll the queues
+	if !sameSlot(r.rc, queue...) {
+		deadline := time.Now().Add(timeout)
+		for {
+			if q, msg, err := r.pop(ctx, factory, queue...); err != ErrNotFound {
+				return q, msg, err
+			}
+			if time.Now().Add(pollInterval).After(deadline) {
+				return "", nil, ErrNotFound
+			}
+			select {
+			case <-ctx.Done():
+				return "", nil, ctx.Err()
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+
+	// BRPOP reply is the pair of the queue name and the message
+	cmd := r.rc.B().Brpop().Key(queue...).Timeout(timeout.Seconds()).Build()
+	values, err := r.rc.Do(ctx, cmd).AsStrSlice()
+	if valkey.IsValkeyNil(err) {
+		return "", nil, ErrNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if r.discardExpired(values[0], []byte(values[1])) {
+		return values[0], nil, errExpired
+	}
+	message, err := rawToMessage(factory, []byte(values[1]))
+	return values[0], message, err
+}
+
+// pop removes and get the last message of the first non-empty queue (or errExpired if the message expired)
+func (r *ValkeyAdapter) pop(ctx context.Context, factory MessageFactory, queue ...string) (string, IMessage, error) {
+	for _, q := range queue {
+		cmd := r.rc.B().Rpop().Key(q).Build()
+		bytes, err := r.rc.Do(ctx, cmd).AsBytes()
+		if valkey.IsValkeyNil(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
 		}
+		if r.discardExpired(q, bytes) {
+			return q, nil, errExpired
+		}
+		message, err := rawToMessage(factory, bytes)
+		return q, message, err
 	}
+	return "", nil, ErrNotFound
 }
 
 // CreateProducer creates message producer for specific topic
 func (r *ValkeyAdapter) CreateProducer(topic string) (IMessageProducer, error) {
 	return &producer{
-		rc:    r.rc,
-		topic: topic,
+		rc:     r.rc,
+		topic:  topic,
+		config: r.config,
 	}, nil
 }
 
 // CreateConsumer creates message consumer for a specific topic
 func (r *ValkeyAdapter) CreateConsumer(subscription string, mf MessageFactory, topics ...string) (IMessageConsumer, error) {
 
-	topicArray := make([]string, 0)
+	sub := newSubscriber(subscription, mf, topics...)
+	messages := make(chan IMessage, consumerBufferSize)
 
-	// Check if topics include * - in this case it should be patterned subscribe
-	isPattern := false
-	for _, t := range topics {
-		if strings.Contains(t, "*") {
-			isPattern = true
+	// Block the receive loop when the buffer is full, until the consumer reads or closed (the subscription context is
+	// canceled before the unsubscribe, which is not confirmed while the receive loop is blocked)
+	sub.deliver = func(topic string, raw []byte, message IMessage) {
+		select {
+		case messages <- message:
+		case <-sub.ctx.Done():
 		}
-		topicArray = append(topicArray, t)
 	}
 
-	var ps *valkey.PubSubHooks
-
-	//if isPattern {
-	//	ps = r.rc.PSubscribe(r.ctx, topics...)
-	//} else {
-	//	ps = r.rc.Subscribe(r.ctx, topics...)
-	//}
+	subscriptionId, err := r.subscribe(sub)
+	if err != nil {
+		return nil, err
+	}
 
 	return &consumer{
-		ps:        ps,
-		factory:   mf,
-		isPattern: isPattern,
-		topics:    topicArray,
+		bus:            r,
+		subscriptionId: subscriptionId,
+		messages:       messages,
+		done:           sub.done,
 	}, nil
 }
 
+// EscapeTopic escapes the glob-style pattern characters of the topic to subscribe to the exact topic, e.g. the
+// topic "alerts*" is subscribed as pattern matching all the topics starting with "alerts", use EscapeTopic("alerts*")
+// to subscribe only to the topic "alerts*"
+func EscapeTopic(topic string) string {
+	var sb strings.Builder
+	for i := 0; i < len(topic); i++ {
+		if strings.IndexByte(topicSpecialChars, topic[i]) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(topic[i])
+	}
+	return sb.String()
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// publishSource is the script publishing the message to the channel and pushing it to the queue of every live
+// subscriber group, the registration, members and queue of expired groups are removed
+// The group queues and members keys are not declared since the groups are known only inside the script, they are
+// derived from the topic hash tag of KEYS[1] and the script checks KEYS[1] is the groups hash of the channel, so
+// all the keys it accesses are in the slot of KEYS[1]
+// KEYS[1] - the topic groups hash (group name -> registration deadline in milliseconds)
+// ARGV[1] - the channel, ARGV[2] - the raw message, ARGV[3] - the publish command (PUBLISH or SPUBLISH)
+const publishSource = `
+if ARGV[1] == '' or KEYS[1] ~= '{' .. ARGV[1] .. '}:groups' then
+	return redis.error_reply('ERR groups key ' .. KEYS[1] .. ' is not in the slot of topic ' .. ARGV[1])
+end
+local now = redis.call('TIME')
+local ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local groups = redis.call('HGETALL', KEYS[1])
+for i = 1, #groups, 2 do
+	if tonumber(groups[i + 1]) >= ms then
+		redis.call('LPUSH', KEYS[1] .. ':' .. groups[i], ARGV[2])
+	else
+		redis.call('HDEL', KEYS[1], groups[i])
+		redis.call('DEL', KEYS[1] .. ':' .. groups[i], '{' .. ARGV[1] .. '}:members:' .. groups[i])
+	end
+end
+return redis.call(ARGV[3], ARGV[1], ARGV[2])
+`
+
+// publishScript executes the publish script of a single message
+var publishScript = valkey.NewLuaScript(publishSource)
+
+// publishSha is the digest of the publish script used to execute it for bulk messages
+var publishSha = scriptSha(publishSource)
+
+// publish messages to their channels and subscriber groups in a single round trip (or transaction in atomic batch
+// mode), sharded messages are published to the topic slot owner
+func publish(rc valkey.Client, config busConfig, messages ...IMessage) error {
+	command := publishCommand(config.sharded)
+	b := encodeBatch(messages, config.injectors, func(b *batch, index int, message IMessage, raw string) {
+		key := groupsKey(message.Topic())
+		evalsha := rc.B().Evalsha().Sha1(publishSha).Numkeys(1).Key(key).Arg(message.Topic(), raw, command).Build()
+		eval := rc.B().Eval().Script(publishSource).Numkeys(1).Key(key).Arg(message.Topic(), raw, command).Build()
+		b.addScript(index, evalsha, eval, key)
+	})
+	return b.exec(rc, config.atomicBatch)
+}
+
+// publishRaw publish raw message to the channel and subscriber groups
+func publishRaw(rc valkey.Client, sharded bool, topic string, bytes []byte) error {
+	return publishScript.Exec(context.Background(), rc, []string{groupsKey(topic)}, []string{topic, string(bytes), publishCommand(sharded)}).Error()
+}
+
+// publishCommand returns the command used to publish messages: PUBLISH or SPUBLISH in sharded mode
+func publishCommand(sharded bool) string {
+	if sharded {
+		return "SPUBLISH"
+	}
+	return "PUBLISH"
+}
+
+// groupsKey is the key of the hash holding the subscriber groups of the topic
+func groupsKey(topic string) string {
+	return fmt.Sprintf("{%s}:groups", topic)
+}
+
+// isPatternTopic checks if the topic includes glob-style pattern characters (*, ? or [) which are not escaped
+func isPatternTopic(topic string) bool {
+	for i := 0; i < len(topic); i++ {
+		switch topic[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeTopic removes the escape characters of the pattern characters from the exact topic
+func unescapeTopic(topic string) string {
+	var sb strings.Builder
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '\\' && i+1 < len(topic) && strings.IndexByte(topicSpecialChars, topic[i+1]) >= 0 {
+			i++
+		}
+		sb.WriteByte(topic[i])
+	}
+	return sb.String()
+}
+
+// unregisterScript removes the group member and the group registration when the group has no other live member, the
+// group queue expires unless the group is registered again
+// KEYS[1] - the topic groups hash, KEYS[2] - the group members hash (member -> deadline in milliseconds),
+// KEYS[3] - the group queue, ARGV[1] - group name, ARGV[2] - member, ARGV[3] - queue time to live in milliseconds
+var unregisterScript = valkey.NewLuaScript(`
+redis.call('HDEL', KEYS[2], ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local members = redis.call('HGETALL', KEYS[2])
+for i = 1, #members, 2 do
+	if tonumber(members[i + 1]) < now then
+		redis.call('HDEL', KEYS[2], members[i])
+	end
+end
+if redis.call('HLEN', KEYS[2]) == 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('PEXPIRE', KEYS[3], ARGV[3])
+end
+return 1
+`)
+
+// membersKey is the key of the hash holding the message bus instances which are members of the subscriber group on
+// the topic (and their registration deadline), kept in the topic cluster slot
+func membersKey(topic, name string) string {
+	return fmt.Sprintf("{%s}:members:%s", topic, name)
+}
+
+// groupQueueKey is the key of the list queueing the topic messages for the subscriber group
+func groupQueueKey(topic, name string) string {
+	return fmt.Sprintf("%s:%s", groupsKey(topic), name)
+}
+
 // endregion
 
 // region Producer actions ---------------------------------------------------------------------------------------------
 
 type producer struct {
-	rc    valkey.Client
-	topic string
+	rc     valkey.Client
+	topic  string
+	config busConfig
 }
 
 // Close cache and free resources
@@ -211,17 +890,7 @@ func (p *producer) Close() error {
 
 // Publish messages to a channel (topic)
 func (p *producer) Publish(messages ...IMessage) error {
-	for _, message := range messages {
-		if bytes, err := messageToRaw(message); err != nil {
-			return err
-		} else {
-			cmd := p.rc.B().Publish().Channel(message.Topic()).Message(string(bytes)).Build()
-			if res := p.rc.Do(context.Background(), cmd); res.Error() != nil {
-				return res.Error()
-			}
-		}
-	}
-	return nil
+	return publish(p.rc, p.config, messages...)
 }
 
 // endregion
@@ -229,24 +898,15 @@ func (p *producer) Publish(messages ...IMessage) error {
 // region Consumer methods  --------------------------------------------------------------------------------------------
 
 type consumer struct {
-	ps        *valkey.PubSubHooks
-	factory   MessageFactory
-	isPattern bool
-	topics    []string
+	bus            *ValkeyAdapter
+	subscriptionId string
+	messages       chan IMessage
+	done           chan struct{}
 }
 
 // Close cache and free resources
 func (p *consumer) Close() error {
-
-	if p.ps == nil {
-		return nil
-	}
-
-	//if p.isPattern {
-	//	return p.ps.PUnsubscribe(context.Background(), p.topics...)
-	//} else {
-	//	return p.ps.Unsubscribe(context.Background(), p.topics...)
-	//}
+	p.bus.Unsubscribe(p.subscriptionId)
 	return nil
 }
 
@@ -268,24 +928,21 @@ func (p *consumer) Read(timeout time.Duration) (IMessage, error) {
 		timeout = time.Hour * 24
 	}
 
-	//LOOP:
-	//	for {
-	//		select {
-	//		case m := <-p.ps.Channel():
-	//			if m == nil {
-	//				break LOOP
-	//			}
-	//			message := p.factory()
-	//			if err := Unmarshal([]byte(m.Payload), &message); err != nil {
-	//				return nil, err
-	//			} else {
-	//				return message, nil
-	//			}
-	//		case <-time.After(timeout):
-	//			return nil, fmt.Errorf("read timeout")
-	//		}
-	//	}
-	return nil, fmt.Errorf("read timeout")
+	// Buffered messages are returned first, also when the consumer is closed
+	select {
+	case message := <-p.messages:
+		return message, nil
+	default:
+	}
+
+	select {
+	case message := <-p.messages:
+		return message, nil
+	case <-p.done:
+		return nil, fmt.Errorf("consumer closed")
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("read timeout")
+	}
 }
 
 // endregion
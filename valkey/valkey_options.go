@@ -0,0 +1,254 @@
+// Configuration options of the Valkey message bus implementations
+//
+
+package facilities
+
+import (
+	"time"
+)
+
+// region Message bus options ------------------------------------------------------------------------------------------
+
+// BusOption configures the Valkey message bus, options are provided to the message bus factory methods
+type BusOption func(config *busConfig)
+
+// busConfig holds the message bus configuration
+type busConfig struct {
+	visibilityTimeout  time.Duration
+	reclaimInterval    time.Duration
+	deadLetterAttempts int64
+	processingTimeout  time.Duration
+	priorities         int
+	sharded            bool
+	atomicBatch        bool
+	injectors          []HeaderInjector
+	subscription       []SubscriptionOption
+	retry              RetryPolicy
+	dedupWindow        time.Duration
+	pushDedupWindow    time.Duration
+	dedupKey           DedupKeyFunc
+	expiredSink        string
+	retention          map[string]RetentionPolicy
+}
+
+// newBusConfig creates the message bus configuration with the default values and apply the options
+func newBusConfig(options ...BusOption) busConfig {
+	config := busConfig{
+		visibilityTimeout: time.Minute,
+		reclaimInterval:   time.Second * 30,
+		dedupKey:          sessionId,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	return config
+}
+
+// WithVisibilityTimeout sets the time a stream message may stay pending (not acknowledged) by a consumer before it is
+// claimed and redelivered to a live consumer of the same group (default is one minute)
+func WithVisibilityTimeout(timeout time.Duration) BusOption {
+	return func(config *busConfig) {
+		config.visibilityTimeout = timeout
+	}
+}
+
+// WithReclaimInterval sets the interval between checks for pending stream messages to reclaim (default is 30 seconds)
+func WithReclaimInterval(interval time.Duration) BusOption {
+	return func(config *busConfig) {
+		config.reclaimInterval = interval
+	}
+}
+
+// WithDeadLetter enables the dead letter queue: a message rejected by the subscription callback (returns false) for
+// the max attempts, or which failed the callback with panic, is moved to the topic dead letter queue (<topic>:dlq)
+func WithDeadLetter(maxAttempts int) BusOption {
+	return func(config *busConfig) {
+		config.deadLetterAttempts = int64(maxAttempts)
+	}
+}
+
+// WithRetryPolicy enables redelivery of messages rejected by the subscription callback (returns false) or which failed
+// the callback with panic, with exponential backoff between the attempts (see RetryPolicy). The retries of subscriber
+// groups and stream subscriptions are scheduled in Valkey, subscriptions without name or with pattern topics can't be
+// retried and Subscribe returns error. When dead letter queue is enabled, the message is moved to the dead letter queue
+// after the max attempts of the retry policy
+func WithRetryPolicy(policy RetryPolicy) BusOption {
+	return func(config *busConfig) {
+		config.retry = policy
+	}
+}
+
+// WithDeduplication enables idempotent consumption: the id of every message (see WithDedupKey) is recorded by the
+// subscriber before the callback runs, duplicate messages received within the window are acknowledged and skipped
+// (see IDeduplicator). Subscriber groups share the recorded ids, other subscriptions record the ids of their own
+func WithDeduplication(window time.Duration) BusOption {
+	return func(config *busConfig) {
+		config.dedupWindow = window
+	}
+}
+
+// WithPushDeduplication enables deduplication of queue messages: Push (and the priority and delayed pushes) ignores a
+// message if its id (see WithDedupKey) was already pushed to the queue within the window
+func WithPushDeduplication(window time.Duration) BusOption {
+	return func(config *busConfig) {
+		config.pushDedupWindow = window
+	}
+}
+
+// WithDedupKey sets the function returning the message id used for deduplication (default is the message session id)
+func WithDedupKey(key DedupKeyFunc) BusOption {
+	return func(config *busConfig) {
+		config.dedupKey = key
+	}
+}
+
+// WithMessageTTL sets the default time to live of the messages sent by the message bus, messages sent with expiration
+// time (see IMessageExpiration) keep their own. Expired messages are discarded by the consumers
+func WithMessageTTL(ttl time.Duration) BusOption {
+	return func(config *busConfig) {
+		config.injectors = append(config.injectors, expiration(ttl, false))
+	}
+}
+
+// WithExpiredSink moves the expired messages to the given queue instead of discarding them, the messages are pushed
+// to the sink without their expiration time
+func WithExpiredSink(queue string) BusOption {
+	return func(config *busConfig) {
+		config.expiredSink = queue
+	}
+}
+
+// WithStreamRetention sets the retention policy of the topic stream (stream bus only): the stream is trimmed to the
+// limits of the policy on publish and periodically by the message bus (see IStreamRetention)
+func WithStreamRetention(topic string, policy RetentionPolicy) BusOption {
+	return func(config *busConfig) {
+		if config.retention == nil {
+			config.retention = make(map[string]RetentionPolicy)
+		}
+		config.retention[topic] = policy
+	}
+}
+
+// WithReliableQueue enables reliable queue mode: Pop moves the message to a processing list of the consumer until it is
+// acknowledged (see IReliableQueue), messages not acknowledged within the processing timeout are returned to the queue
+func WithReliableQueue(processingTimeout time.Duration) BusOption {
+	return func(config *busConfig) {
+		config.processingTimeout = processingTimeout
+	}
+}
+
+// WithPriorities enables priority queues with the given number of priority levels above the normal priority (0):
+// messages pushed with higher priority (see IPriorityQueue) are popped before messages with lower priority
+func WithPriorities(levels int) BusOption {
+	return func(config *busConfig) {
+		config.priorities = levels
+	}
+}
+
+// WithShardedPubSub enables sharded pub/sub for Valkey cluster deployments: messages are published using SPUBLISH and
+// received using SSUBSCRIBE from the node owning the topic slot instead of being broadcast to all the cluster nodes.
+// Pattern topics are not supported in sharded mode
+func WithShardedPubSub() BusOption {
+	return func(config *busConfig) {
+		config.sharded = true
+	}
+}
+
+// WithAtomicBatch enables all-or-nothing bulk actions: the messages of a single Publish or Push call are sent in a
+// transaction (MULTI/EXEC), none of them is sent if any of the messages is invalid. In cluster mode all the messages of
+// a batch must be in the same slot
+func WithAtomicBatch() BusOption {
+	return func(config *busConfig) {
+		config.atomicBatch = true
+	}
+}
+
+// WithHeaders adds header injector called for every message sent by the message bus, the message is sent with its
+// headers in envelope (see IMessageHeaders)
+func WithHeaders(injector HeaderInjector) BusOption {
+	return func(config *busConfig) {
+		config.injectors = append(config.injectors, injector)
+	}
+}
+
+// WithSubscriptionDefaults sets the default options of the subscriptions (see SubscriptionOption)
+func WithSubscriptionDefaults(options ...SubscriptionOption) BusOption {
+	return func(config *busConfig) {
+		config.subscription = append(config.subscription, options...)
+	}
+}
+
+// endregion
+
+// region Subscription options -----------------------------------------------------------------------------------------
+
+// OverflowPolicy is the action taken when a message arrives and the subscription buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the subscription reader until there is room in the buffer or the subscription stops (default)
+	// Messages of subscriber groups which are not processed when the subscription stops are returned to the group queue
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered message to make room for the new message
+	OverflowDropOldest
+	// OverflowDropNewest drops the new message
+	OverflowDropNewest
+)
+
+// SubscriptionOption configures the processing of the subscription messages, options are provided to the message bus
+// factory methods (WithSubscriptionDefaults) or to a single subscription (ISubscriber.SubscribeWith)
+type SubscriptionOption func(config *subscriptionConfig)
+
+// subscriptionConfig holds the subscription configuration
+type subscriptionConfig struct {
+	concurrency int
+	bufferSize  int
+	overflow    OverflowPolicy
+	startFrom   StreamOffset
+}
+
+// newSubscriptionConfig creates the subscription configuration with the default values and apply the options
+func newSubscriptionConfig(options ...SubscriptionOption) subscriptionConfig {
+	config := subscriptionConfig{
+		concurrency: defaultConcurrency,
+		bufferSize:  consumerBufferSize,
+		overflow:    OverflowBlock,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	return config
+}
+
+// WithConcurrency sets the maximum number of callbacks processing the subscription messages at the same time
+func WithConcurrency(maxInFlight int) SubscriptionOption {
+	return func(config *subscriptionConfig) {
+		config.concurrency = maxInFlight
+	}
+}
+
+// WithOrdered processes the subscription messages one at a time, in the order they were received
+func WithOrdered() SubscriptionOption {
+	return func(config *subscriptionConfig) {
+		config.concurrency = 1
+	}
+}
+
+// WithBuffer sets the maximum number of messages waiting for processing and the policy when the buffer is full
+func WithBuffer(size int, overflow OverflowPolicy) SubscriptionOption {
+	return func(config *subscriptionConfig) {
+		config.bufferSize = size
+		config.overflow = overflow
+	}
+}
+
+// StartFrom sets the offset of the first message delivered to a new stream subscriber group (default is OffsetLatest),
+// existing groups continue from their last delivered message. Used only by stream subscriptions and consumers
+// (see IStreamConsumer)
+func StartFrom(offset StreamOffset) SubscriptionOption {
+	return func(config *subscriptionConfig) {
+		config.startFrom = offset
+	}
+}
+
+// endregion
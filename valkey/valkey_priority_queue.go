@@ -0,0 +1,70 @@
+// Priority queue: messages pushed with higher priority are popped before messages with lower priority
+//
+
+package facilities
+
+import (
+	"fmt"
+
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IPriorityQueue is implemented by the Valkey message buses configured with priority levels (WithPriorities)
+// Every priority level above the normal priority is kept in a dedicated list (<queue>:priority:<level>), Pop checks
+// the lists from the highest priority down to the queue itself, so the highest priority message is always popped first
+type IPriorityQueue interface {
+
+	// PushWithPriority Append one or multiple messages to a queue with the given priority (0 is the normal priority)
+	PushWithPriority(priority int, messages ...IMessage) error
+}
+
+// endregion
+
+// region Priority queue actions ---------------------------------------------------------------------------------------
+
+// PushWithPriority Append one or multiple messages to a queue with the given priority (0 is the normal priority)
+func (r *ValkeyAdapter) PushWithPriority(priority int, messages ...IMessage) error {
+
+	if priority < 0 || priority > r.config.priorities {
+		return fmt.Errorf("priority %d is out of range [0, %d]", priority, r.config.priorities)
+	}
+
+	b := encodeBatch(messages, r.config.injectors, func(b *batch, index int, message IMessage, raw string) {
+		r.addPush(b, index, message.Topic(), priorityKey(message.Topic(), priority), message, raw)
+	})
+	return b.exec(r.rc, r.config.atomicBatch)
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// priorityKeys returns the keys to pop from in order: the priority lists of all the queues from the highest priority,
+// followed by the queues themselves, and the queue of every key
+func (r *ValkeyAdapter) priorityKeys(queue ...string) ([]string, map[string]string) {
+
+	keys := make([]string, 0, len(queue)*(r.config.priorities+1))
+	source := make(map[string]string, cap(keys))
+
+	for priority := r.config.priorities; priority >= 0; priority-- {
+		for _, q := range queue {
+			key := priorityKey(q, priority)
+			keys = append(keys, key)
+			source[key] = q
+		}
+	}
+	return keys, source
+}
+
+// priorityKey is the key of the list holding the queue messages of the given priority, normal priority messages are
+// kept in the queue itself. The priority lists are kept in the queue cluster slot
+func priorityKey(queue string, priority int) string {
+	if priority == 0 {
+		return queue
+	}
+	return slotKey(queue, fmt.Sprintf("priority:%d", priority))
+}
+
+// endregion
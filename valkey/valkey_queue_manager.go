@@ -0,0 +1,208 @@
+// Queue management: inspect and maintain the queues used by Push / Pop
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/valkey-io/valkey-go"
+
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// queuePageSize is the number of queue messages fetched by a single LRANGE call when scanning a queue
+const queuePageSize = 1000
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// MessagePredicate checks if the message matches a condition
+type MessagePredicate func(message IMessage) bool
+
+// IQueueManager is implemented by the Valkey message buses to inspect and maintain queues
+// The actions include the priority lists of the queue (see IPriorityQueue), the messages in process of reliable queue
+// consumers are not included
+type IQueueManager interface {
+
+	// QueueLength returns the number of messages in the queue
+	QueueLength(queue string) (int64, error)
+
+	// Peek returns up to n messages in the order they will be popped, without removing them from the queue
+	Peek(factory MessageFactory, queue string, n int64) ([]IMessage, error)
+
+	// Purge removes all the messages of the queue, including the delayed messages
+	Purge(queue string) error
+
+	// MoveAll moves all the messages from one queue to the end of the other queue atomically (in cluster mode both
+	// queues must be in the same slot, e.g. using hash tags), return the number of moved messages
+	MoveAll(from, to string) (int64, error)
+
+	// Remove removes the queue messages matching the predicate, return the number of removed messages
+	Remove(factory MessageFactory, queue string, predicate MessagePredicate) (int64, error)
+}
+
+// endregion
+
+// region Queue management actions -------------------------------------------------------------------------------------
+
+// QueueLength returns the number of messages in the queue
+func (r *ValkeyAdapter) QueueLength(queue string) (int64, error) {
+
+	keys, _ := r.priorityKeys(queue)
+
+	cmds := make(valkey.Commands, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, r.rc.B().Llen().Key(key).Build())
+	}
+
+	total := int64(0)
+	for _, res := range r.rc.DoMulti(context.Background(), cmds...) {
+		if count, err := res.AsInt64(); err != nil {
+			return 0, err
+		} else {
+			total += count
+		}
+	}
+	return total, nil
+}
+
+// Peek returns up to n messages in the order they will be popped, without removing them from the queue
+// Messages are popped from the tail of the list, so every list is read backwards from its tail
+func (r *ValkeyAdapter) Peek(factory MessageFactory, queue string, n int64) ([]IMessage, error) {
+
+	result := make([]IMessage, 0)
+	keys, _ := r.priorityKeys(queue)
+
+	for _, key := range keys {
+		if int64(len(result)) >= n {
+			break
+		}
+		cmd := r.rc.B().Lrange().Key(key).Start(-(n - int64(len(result)))).Stop(-1).Build()
+		values, err := r.rc.Do(context.Background(), cmd).AsStrSlice()
+		if err != nil {
+			return nil, err
+		}
+		for i := len(values) - 1; i >= 0; i-- {
+			if message, er := rawToMessage(factory, []byte(values[i])); er != nil {
+				return nil, er
+			} else {
+				result = append(result, message)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Purge removes all the messages of the queue, including the delayed messages
+func (r *ValkeyAdapter) Purge(queue string) error {
+
+	keys, _ := r.priorityKeys(queue)
+	keys = append(keys, delayedKey(queue))
+
+	// Keys are deleted one by one since they may be in different cluster slots
+	cmds := make(valkey.Commands, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, r.rc.B().Del().Key(key).Build())
+	}
+	for _, res := range r.rc.DoMulti(context.Background(), cmds...) {
+		if err := res.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MoveAll moves all the messages from one queue to the end of the other queue atomically (in cluster mode both
+// queues must be in the same slot, e.g. using hash tags), return the number of moved messages
+// Messages of every priority are moved to the same priority of the target queue, the order of the messages is kept
+func (r *ValkeyAdapter) MoveAll(from, to string) (int64, error) {
+
+	if from == to {
+		return 0, fmt.Errorf("can't move queue %s to itself", from)
+	}
+
+	sources, _ := r.priorityKeys(from)
+	targets, _ := r.priorityKeys(to)
+
+	keys := make([]string, 0, len(sources)*2)
+	for i := range sources {
+		keys = append(keys, sources[i], targets[i])
+	}
+	if !sameSlot(r.rc, keys...) {
+		return 0, fmt.Errorf("queues %s and %s are not in the same cluster slot", from, to)
+	}
+
+	return moveAllScript.Exec(context.Background(), r.rc, keys, nil).AsInt64()
+}
+
+// Remove removes the queue messages matching the predicate, return the number of removed messages
+// The queue is scanned and then every matching message is removed, messages popped in the meantime are not removed
+func (r *ValkeyAdapter) Remove(factory MessageFactory, queue string, predicate MessagePredicate) (int64, error) {
+
+	keys, _ := r.priorityKeys(queue)
+
+	cmds := make(valkey.Commands, 0)
+	for _, key := range keys {
+		matches, err := r.scanQueue(factory, key, predicate)
+		if err != nil {
+			return 0, err
+		}
+		for _, raw := range matches {
+			cmds = append(cmds, r.rc.B().Lrem().Key(key).Count(1).Element(raw).Build())
+		}
+	}
+	if len(cmds) == 0 {
+		return 0, nil
+	}
+
+	removed := int64(0)
+	for _, res := range r.rc.DoMulti(context.Background(), cmds...) {
+		if count, err := res.AsInt64(); err != nil {
+			return removed, err
+		} else {
+			removed += count
+		}
+	}
+	return removed, nil
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// moveAllScript moves all the messages between pairs of lists, every message is popped from the tail of the source
+// list and pushed to the head of the target list so the pop order is kept
+// KEYS - pairs of source and target lists
+var moveAllScript = valkey.NewLuaScript(`
+local count = 0
+for i = 1, #KEYS, 2 do
+	while redis.call('RPOPLPUSH', KEYS[i], KEYS[i + 1]) do
+		count = count + 1
+	end
+end
+return count
+`)
+
+// scanQueue returns the raw messages of the list matching the predicate, messages which can't be decoded are skipped
+func (r *ValkeyAdapter) scanQueue(factory MessageFactory, key string, predicate MessagePredicate) ([]string, error) {
+
+	result := make([]string, 0)
+	for start := int64(0); ; start += queuePageSize {
+		cmd := r.rc.B().Lrange().Key(key).Start(start).Stop(start + queuePageSize - 1).Build()
+		values, err := r.rc.Do(context.Background(), cmd).AsStrSlice()
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range values {
+			if message, er := rawToMessage(factory, []byte(raw)); er == nil && predicate(message) {
+				result = append(result, raw)
+			}
+		}
+		if len(values) < queuePageSize {
+			return result, nil
+		}
+	}
+}
+
+// endregion
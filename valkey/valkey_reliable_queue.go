@@ -0,0 +1,336 @@
+// Reliable queue: popped messages are kept in a processing list until they are acknowledged
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// errRequeued is returned by Ack and Nack when the message is no longer in the processing list, it was returned to the
+// queue by the janitor after the processing timeout (and may be delivered to another consumer)
+var errRequeued = fmt.Errorf("message was requeued after processing timeout: %w", ErrNotFound)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// IReliableQueue is implemented by the Valkey message buses configured with reliable queue mode (WithReliableQueue)
+// Messages returned by Pop must be acknowledged when processed, or returned to the queue using Nack
+type IReliableQueue interface {
+
+	// Ack acknowledge the message was processed and remove it from the processing list, return ErrNotFound if the
+	// message is not waiting for acknowledgement (it was already requeued after the processing timeout)
+	Ack(message IMessage) error
+
+	// Nack returns the message to the head of the queue to be redelivered, return ErrNotFound if the message is not
+	// waiting for acknowledgement (it was already requeued after the processing timeout)
+	Nack(message IMessage) error
+}
+
+// inflight is a popped message waiting for acknowledgement
+type inflight struct {
+	queue  string
+	key    string
+	raw    string
+	popped time.Time
+}
+
+// endregion
+
+// region Reliable queue actions ---------------------------------------------------------------------------------------
+
+// Ack acknowledge the message was processed and remove it from the processing list, return ErrNotFound if the message
+// is not waiting for acknowledgement (it was already requeued after the processing timeout)
+func (r *ValkeyAdapter) Ack(message IMessage) error {
+	if item, err := r.takeInflight(message); err != nil {
+		return err
+	} else {
+		keys := []string{processingKey(item.queue, r.consumerId), inflightKey(item.queue)}
+		return requeued(ackScript.Exec(context.Background(), r.rc, keys, []string{item.raw, inflightMember(r.consumerId, item.raw)}))
+	}
+}
+
+// Nack returns the message to the head of the queue to be redelivered, return ErrNotFound if the message is not
+// waiting for acknowledgement (it was already requeued after the processing timeout)
+func (r *ValkeyAdapter) Nack(message IMessage) error {
+	if item, err := r.takeInflight(message); err != nil {
+		return err
+	} else {
+		keys := []string{processingKey(item.queue, r.consumerId), inflightKey(item.queue), item.key}
+		return requeued(nackScript.Exec(context.Background(), r.rc, keys, []string{item.raw, inflightMember(r.consumerId, item.raw)}))
+	}
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// popScript moves the last item of the queue to the consumer processing list and records the time it was popped
+// KEYS[1] - queue or priority list, KEYS[2] - processing list, KEYS[3] - inflight sorted set, KEYS[4] - queue consumers set
+// ARGV[1] - consumer id
+var popScript = valkey.NewLuaScript(`
+local item = redis.call('LMOVE', KEYS[1], KEYS[2], 'RIGHT', 'LEFT')
+if item then
+	local t = redis.call('TIME')
+	redis.call('ZADD', KEYS[3], 'NX', tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000), ARGV[1] .. '|' .. item)
+	redis.call('SADD', KEYS[4], ARGV[1])
+end
+return item
+`)
+
+// trackScript records the time an item was moved to the consumer processing list (used after BLMOVE)
+// KEYS[1] - inflight sorted set, KEYS[2] - queue consumers set, ARGV[1] - consumer id, ARGV[2] - item
+var trackScript = valkey.NewLuaScript(`
+local t = redis.call('TIME')
+redis.call('ZADD', KEYS[1], 'NX', tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000), ARGV[1] .. '|' .. ARGV[2])
+return redis.call('SADD', KEYS[2], ARGV[1])
+`)
+
+// ackScript removes the item from the consumer processing list, return the number of removed items
+// KEYS[1] - processing list, KEYS[2] - inflight sorted set, ARGV[1] - item, ARGV[2] - inflight member
+var ackScript = valkey.NewLuaScript(`
+redis.call('ZREM', KEYS[2], ARGV[2])
+return redis.call('LREM', KEYS[1], 1, ARGV[1])
+`)
+
+// nackScript moves the item from the consumer processing list back to the head of the list it was popped from, return
+// the number of moved items
+// KEYS[1] - processing list, KEYS[2] - inflight sorted set, KEYS[3] - queue or priority list, ARGV[1] - item, ARGV[2] - inflight member
+var nackScript = valkey.NewLuaScript(`
+redis.call('ZREM', KEYS[2], ARGV[2])
+local count = redis.call('LREM', KEYS[1], 1, ARGV[1])
+if count > 0 then
+	redis.call('RPUSH', KEYS[3], ARGV[1])
+end
+return count
+`)
+
+// janitorScript requeues items which are in the processing lists longer than the processing timeout
+// Items in processing lists without inflight record (consumer failed right after BLMOVE) start their clock now
+// Requeued items are returned to the queue itself, also if they were popped from a priority list
+// KEYS[1] - queue, KEYS[2] - inflight sorted set, KEYS[3] - queue consumers set
+// ARGV[1] - processing list key prefix, ARGV[2] - processing timeout in milliseconds
+var janitorScript = valkey.NewLuaScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+for _, consumer in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+	local items = redis.call('LRANGE', ARGV[1] .. consumer, 0, -1)
+	if #items == 0 then
+		redis.call('SREM', KEYS[3], consumer)
+	end
+	for _, item in ipairs(items) do
+		redis.call('ZADD', KEYS[2], 'NX', now, consumer .. '|' .. item)
+	end
+end
+local count = 0
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now - tonumber(ARGV[2]))) do
+	local sep = string.find(member, '|', 1, true)
+	local item = string.sub(member, sep + 1)
+	if redis.call('LREM', ARGV[1] .. string.sub(member, 1, sep - 1), 1, item) > 0 then
+		redis.call('RPUSH', KEYS[1], item)
+		count = count + 1
+	end
+	redis.call('ZREM', KEYS[2], member)
+end
+return count
+`)
+
+// reliablePop moves a message from one of the lists (queues or priority lists) to the consumer processing list of
+// the list queue or block until timeout expires or the context is canceled, return the queue the message was taken from
+func (r *ValkeyAdapter) reliablePop(ctx context.Context, factory MessageFactory, timeout time.Duration, source map[string]string, keys ...string) (string, IMessage, error) {
+
+	queue := make([]string, 0, len(source))
+	for _, q := range source {
+		queue = append(queue, q)
+	}
+	r.startJanitor(queue...)
+
+	// Blocking move is available only for a single queue, the consumer is registered before the move to let the
+	// janitor find the processing list also if the consumer fails before the message is tracked
+	if timeout > 0 && len(keys) == 1 {
+		if err := r.rc.Do(ctx, r.rc.B().Sadd().Key(consumersKey(queue[0])).Member(r.consumerId).Build()).Error(); err != nil {
+			return "", nil, err
+		}
+		cmd := r.rc.B().Blmove().Source(queue[0]).Destination(processingKey(queue[0], r.consumerId)).Right().Left().Timeout(timeout.Seconds()).Build()
+		item, err := r.rc.Do(ctx, cmd).ToString()
+		if valkey.IsValkeyNil(err) {
+			return "", nil, ErrNotFound
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		keys := []string{inflightKey(queue[0]), consumersKey(queue[0])}
+		if err = trackScript.Exec(context.Background(), r.rc, keys, []string{r.consumerId, item}).Error(); err != nil {
+			logger.Warn("error tracking message popped from %s: %s", queue[0], err.Error())
+		}
+		return r.addInflight(factory, queue[0], queue[0], item)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, key := range keys {
+			q := source[key]
+			scriptKeys := []string{key, processingKey(q, r.consumerId), inflightKey(q), consumersKey(q)}
+			item, err := popScript.Exec(ctx, r.rc, scriptKeys, []string{r.consumerId}).ToString()
+			if err == nil {
+				return r.addInflight(factory, q, key, item)
+			}
+			if !valkey.IsValkeyNil(err) {
+				return "", nil, err
+			}
+		}
+		if time.Now().Add(pollInterval).After(deadline) {
+			return "", nil, ErrNotFound
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// addInflight decodes the item popped from the list (queue or priority list) and keep it until the message is acknowledged
+// Expired messages are removed from the processing list and errExpired is returned
+func (r *ValkeyAdapter) addInflight(factory MessageFactory, queue, key, item string) (string, IMessage, error) {
+
+	if r.discardExpired(queue, []byte(item)) {
+		keys := []string{processingKey(queue, r.consumerId), inflightKey(queue)}
+		_ = ackScript.Exec(context.Background(), r.rc, keys, []string{item, inflightMember(r.consumerId, item)})
+		return queue, nil, errExpired
+	}
+
+	message, err := rawToMessage(factory, []byte(item))
+	if err != nil {
+		// The message can't be decoded, remove it from the processing list
+		keys := []string{processingKey(queue, r.consumerId), inflightKey(queue)}
+		_ = ackScript.Exec(context.Background(), r.rc, keys, []string{item, inflightMember(r.consumerId, item)})
+		return queue, nil, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.inflight[inflightRef(message)] = inflight{queue: queue, key: key, raw: item, popped: time.Now()}
+	return queue, message, nil
+}
+
+// takeInflight removes the message from the messages waiting for acknowledgement, return ErrNotFound if the message
+// is not waiting for acknowledgement (also when it was evicted after the processing timeout)
+func (r *ValkeyAdapter) takeInflight(message IMessage) (inflight, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	ref := inflightRef(message)
+	if item, ok := r.inflight[ref]; !ok {
+		return inflight{}, fmt.Errorf("message is not waiting for acknowledgement: %w", ErrNotFound)
+	} else {
+		delete(r.inflight, ref)
+		return item, nil
+	}
+}
+
+// evictInflight removes the messages waiting for acknowledgement longer than the processing timeout, these messages
+// are requeued by the janitor and their acknowledgement returns ErrNotFound
+func (r *ValkeyAdapter) evictInflight() {
+	r.Lock()
+	defer r.Unlock()
+
+	for ref, item := range r.inflight {
+		if time.Since(item.popped) > r.config.processingTimeout {
+			delete(r.inflight, ref)
+		}
+	}
+}
+
+// inflightRef returns the key of the message in the messages waiting for acknowledgement: the message itself when
+// its type is comparable (pointer messages by identity), otherwise the message topic and session id
+func inflightRef(message IMessage) any {
+	if reflect.TypeOf(message).Comparable() {
+		return message
+	}
+	return fmt.Sprintf("%s|%s", message.Topic(), message.SessionId())
+}
+
+// requeued returns errRequeued if the acknowledgement script found no item in the processing list
+func requeued(result valkey.ValkeyResult) error {
+	if count, err := result.AsInt64(); err != nil {
+		return err
+	} else if count == 0 {
+		return errRequeued
+	}
+	return nil
+}
+
+// startJanitor starts (once) the janitor requeuing timed out messages of the queues this consumer pops from
+func (r *ValkeyAdapter) startJanitor(queue ...string) {
+	r.registerQueues(queue...)
+	r.janitor.Do(func() {
+		go r.runJanitor()
+	})
+}
+
+// runJanitor is a function running a loop which periodically requeue timed out messages until the bus is closed
+func (r *ValkeyAdapter) runJanitor() {
+
+	ticker := time.NewTicker(max(r.config.processingTimeout/2, pollInterval))
+	defer ticker.Stop()
+
+	timeout := fmt.Sprintf("%d", r.config.processingTimeout.Milliseconds())
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.evictInflight()
+
+		r.RLock()
+		queues := make([]string, 0, len(r.queues))
+		for q := range r.queues {
+			queues = append(queues, q)
+		}
+		r.RUnlock()
+
+		for _, q := range queues {
+			keys := []string{q, inflightKey(q), consumersKey(q)}
+			if count, err := janitorScript.Exec(r.ctx, r.rc, keys, []string{processingKey(q, ""), timeout}).AsInt64(); err != nil {
+				if r.ctx.Err() == nil {
+					logger.Warn("error requeue timed out messages of %s: %s", q, err.Error())
+				}
+			} else if count > 0 {
+				logger.Warn("%d timed out messages returned to %s", count, q)
+			}
+		}
+	}
+}
+
+// processingKey is the key of the consumer processing list of the queue
+func processingKey(queue, consumerId string) string {
+	return fmt.Sprintf("{%s}:processing:%s", queue, consumerId)
+}
+
+// inflightKey is the key of the sorted set holding the time each processed item of the queue was popped
+func inflightKey(queue string) string {
+	return fmt.Sprintf("{%s}:inflight", queue)
+}
+
+// consumersKey is the key of the set holding the ids of the consumers popping from the queue
+func consumersKey(queue string) string {
+	return fmt.Sprintf("{%s}:consumers", queue)
+}
+
+// inflightMember is the member of an item in the inflight sorted set
+func inflightMember(consumerId, item string) string {
+	return fmt.Sprintf("%s|%s", consumerId, item)
+}
+
+// endregion
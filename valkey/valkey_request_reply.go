@@ -0,0 +1,191 @@
+// Request / reply: synchronous request over the message bus, the reply is sent back to the requester reply channel
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/go-yaaf/yaaf-common/entity"
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// Request / reply headers
+const (
+	HeaderReplyTo    = "reply-to"    // The channel of the request reply
+	HeaderReplyError = "reply-error" // The error returned by the request handler
+)
+
+// serveGroup is the subscriber group of the request handlers, every request is served by a single handler of the topic
+const serveGroup = "serve"
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// RequestHandler is the function serving a request, the returned message (or error) is sent back to the requester
+type RequestHandler func(request IMessage) (IMessage, error)
+
+// IRequestReply is implemented by the Valkey message buses for synchronous request / reply
+// The request is published with a reply channel and correlation id headers (HeaderReplyTo, HeaderCorrelationId), the
+// requester subscribes to the reply channel until the reply arrives or the timeout expires. Requests and replies are
+// sent over pub/sub in both message buses
+type IRequestReply interface {
+
+	// Request publishes the request and waits for the reply, the reply is decoded using the message factory
+	// Zero timeout waits until the reply arrives or the context is canceled
+	Request(ctx context.Context, request IMessage, factory MessageFactory, timeout time.Duration) (IMessage, error)
+
+	// Serve the requests published to the topic by the handler, the returned subscription id is used to stop serving
+	// (Unsubscribe). Every request is served by a single handler of the topic
+	Serve(topic string, factory MessageFactory, handler RequestHandler) (string, error)
+}
+
+// endregion
+
+// region Request / reply actions --------------------------------------------------------------------------------------
+
+// Request publishes the request and waits for the reply, the reply is decoded using the message factory
+// Return error if the timeout expires or the context is canceled before the reply arrives, or the error of the handler
+// Zero timeout waits until the reply arrives or the context is canceled
+func (r *ValkeyAdapter) Request(ctx context.Context, request IMessage, factory MessageFactory, timeout time.Duration) (IMessage, error) {
+
+	correlationId := NanoID()
+	replyTo := replyKey(correlationId)
+
+	// The reply is received as raw data and decoded once by the requester
+	replies := make(chan []byte, 1)
+	sub := &subscriber{
+		name:   fmt.Sprintf("request:%s", correlationId),
+		topics: []string{replyTo},
+		done:   make(chan struct{}),
+	}
+	sub.notify = func(channel string, payload string) {
+		select {
+		case replies <- []byte(payload):
+		default:
+		}
+	}
+
+	// The reply channel is subscribed before the request is published to not miss a fast reply
+	subscriptionId, err := r.subscribe(sub)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Unsubscribe(subscriptionId)
+
+	config := r.config
+	config.injectors = append(append([]HeaderInjector{}, r.config.injectors...), func(message IMessage, headers map[string]string) {
+		headers[HeaderReplyTo] = replyTo
+		headers[HeaderCorrelationId] = correlationId
+	})
+	if err = publish(r.rc, config, request); err != nil {
+		return nil, err
+	}
+
+	// Zero timeout never expires (receive from nil channel blocks)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-expired:
+		return nil, fmt.Errorf("request to %s timed out after %s", request.Topic(), timeout.String())
+	case raw := <-replies:
+		if reason := rawHeader(raw, HeaderReplyError); len(reason) > 0 {
+			return nil, fmt.Errorf("%s", reason)
+		}
+		return rawToMessage(factory, raw)
+	}
+}
+
+// Serve the requests published to the topic by the handler, the returned subscription id is used to stop serving
+// (Unsubscribe). Every request is served by a single handler of the topic
+func (r *ValkeyAdapter) Serve(topic string, factory MessageFactory, handler RequestHandler) (string, error) {
+
+	// Validate handler
+	if handler == nil {
+		return "", fmt.Errorf("handler is nil")
+	}
+	if isPatternTopic(topic) {
+		return "", fmt.Errorf("pattern topic %s can't be served", topic)
+	}
+
+	sub := newSubscriber(serveGroup, factory, topic)
+
+	// Requests are processed by the subscription workers, the raw request holds the reply headers
+	pool := newWorkerPool(serveGroup, newSubscriptionConfig(r.config.subscription...), sub.done)
+	sub.pool = pool
+	sub.deliver = func(topic string, raw []byte, message IMessage) {
+		pool.submit(sub.ctx, func() {
+			r.serve(sub, topic, raw, message, handler)
+		}, r.undelivered(sub, topic, raw))
+	}
+
+	subscriptionId, err := r.subscribeGroup(sub)
+	if err == nil {
+		pool.start()
+	}
+	return subscriptionId, err
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// serve invokes the request handler and publish the reply (or the handler error) to the request reply channel
+func (r *ValkeyAdapter) serve(sub *subscriber, topic string, raw []byte, request IMessage, handler RequestHandler) {
+
+	replyTo := rawHeader(raw, HeaderReplyTo)
+	if len(replyTo) == 0 {
+		logger.Warn("[%s] request from %s has no reply channel", serveGroup, topic)
+		return
+	}
+
+	reply, err := invokeHandler(handler, request)
+	if err != nil {
+		sub.stats.failed.Add(1)
+	} else {
+		sub.stats.processed.Add(1)
+	}
+
+	headers := map[string]string{HeaderCorrelationId: rawHeader(raw, HeaderCorrelationId)}
+	if err != nil {
+		headers[HeaderReplyError] = err.Error()
+	}
+	bytes, er := messageToRaw(reply, func(message IMessage, h map[string]string) {
+		for key, value := range headers {
+			h[key] = value
+		}
+	})
+	if er != nil {
+		logger.Error("[%s] error encoding reply of request from %s: %s", serveGroup, topic, er.Error())
+		return
+	}
+	if er = publishRaw(r.rc, r.config.sharded, replyTo, bytes); er != nil {
+		logger.Error("[%s] error sending reply of request from %s: %s", serveGroup, topic, er.Error())
+	}
+}
+
+// invokeHandler calls the request handler, return error on panic
+func invokeHandler(handler RequestHandler, request IMessage) (reply IMessage, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("request handler panic: %v", p)
+		}
+	}()
+	return handler(request)
+}
+
+// replyKey is the channel of the request reply
+func replyKey(correlationId string) string {
+	return fmt.Sprintf("reply:%s", correlationId)
+}
+
+// endregion
@@ -0,0 +1,176 @@
+// Retry policy: failed messages are redelivered with exponential backoff, retries are scheduled in Valkey
+//
+
+package facilities
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+
+	. "github.com/go-yaaf/yaaf-common/entity"
+	"github.com/go-yaaf/yaaf-common/logger"
+)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// RetryPolicy defines the redelivery of messages failed by the subscription callback (see WithRetryPolicy)
+// The delay before retry n is InitialDelay * Multiplier^(n-1), changed randomly by up to Jitter of the delay and bounded
+// by MaxDelay. The number of retries is carried in the message header (HeaderRetryCount)
+type RetryPolicy struct {
+	MaxAttempts  int           // Maximum number of attempts including the first delivery
+	InitialDelay time.Duration // Delay before the first retry
+	Multiplier   float64       // Factor applied to the delay of every subsequent retry (1 if not set)
+	Jitter       float64       // Fraction of the delay randomly added or removed [0, 1]
+	MaxDelay     time.Duration // Upper bound of the delay (no bound if not set)
+}
+
+// Delay returns the delay before the given retry (1 is the first retry)
+func (p RetryPolicy) Delay(retry int) time.Duration {
+
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialDelay)
+	for i := 1; i < retry; i++ {
+		delay *= multiplier
+		if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// enabled checks if the retry policy is configured
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 0
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// retryScript moves the due retries from the subscriber retry sorted set to the redelivery list (LPUSH) or stream
+// (XADD), the retries are removed from the sorted set and added in a single script so a retry is never moved twice
+// KEYS[1] - retry sorted set, KEYS[2] - list or stream, ARGV[1] - maximum number of retries to move,
+// ARGV[2] - 'list' or 'stream', ARGV[3] - stream entry field
+var retryScript = valkey.NewLuaScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, tonumber(ARGV[1]))
+for _, member in ipairs(members) do
+	redis.call('ZREM', KEYS[1], member)
+	local raw = string.sub(member, string.find(member, '|', 1, true) + 1)
+	if ARGV[2] == 'stream' then
+		redis.call('XADD', KEYS[2], '*', ARGV[3], raw)
+	else
+		redis.call('LPUSH', KEYS[2], raw)
+	end
+end
+return #members
+`)
+
+// retryCount returns the number of times the raw message was retried
+func retryCount(raw []byte) int {
+	count, _ := strconv.Atoi(rawHeader(raw, HeaderRetryCount))
+	return count
+}
+
+// exhausted checks if the message failed for the max attempts of the retry policy, the message is moved to the dead
+// letter queue (when enabled) or dropped
+func (r *ValkeyAdapter) exhausted(topic, subscriberName string, raw []byte, attempts int64, reason error) bool {
+	if attempts < int64(r.config.retry.MaxAttempts) {
+		return false
+	}
+	r.giveUp(topic, subscriberName, raw, attempts, reason)
+	return true
+}
+
+// giveUp stops retrying the message, the message is moved to the dead letter queue (when enabled) or dropped
+func (r *ValkeyAdapter) giveUp(topic, subscriberName string, raw []byte, attempts int64, reason error) {
+	if r.config.deadLetterAttempts > 0 {
+		r.deadLetter(topic, subscriberName, raw, attempts, reason)
+	} else {
+		logger.Warn("[%s] message from %s dropped after %d attempts: %s", subscriberName, topic, attempts, reason.Error())
+	}
+}
+
+// scheduleRetry adds the message to the subscriber retry sorted set (scored by due time in milliseconds) with the
+// incremented retry count, the retry is moved to the redelivery queue by the subscriber retry scheduler
+func (r *ValkeyAdapter) scheduleRetry(topic, subscriberName string, raw []byte) error {
+
+	retry := retryCount(raw) + 1
+	raw, err := setRawHeader(raw, HeaderRetryCount, strconv.Itoa(retry))
+	if err != nil {
+		return err
+	}
+
+	// The member is prefixed with unique id to keep identical messages scheduled at the same time
+	due := time.Now().Add(r.config.retry.Delay(retry))
+	member := fmt.Sprintf("%s|%s", NanoID(), raw)
+	cmd := r.rc.B().Zadd().Key(retryKey(topic, subscriberName)).ScoreMember().ScoreMember(float64(due.UnixMilli()), member).Build()
+	return r.rc.Do(context.Background(), cmd).Error()
+}
+
+// retryScheduler is a function running a loop which periodically moves the due retries of the subscriber to the
+// redelivery list or stream of each topic until it is canceled
+func (r *ValkeyAdapter) retryScheduler(ctx context.Context, sub *subscriber, target func(topic string) string, kind string) {
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, topic := range sub.topics {
+			keys := []string{retryKey(topic, sub.name), target(topic)}
+			// Topics with names that can't be used as hash tag have no retries in cluster mode
+			if !sameSlot(r.rc, keys...) {
+				continue
+			}
+			for ctx.Err() == nil {
+				count, err := retryScript.Exec(ctx, r.rc, keys, []string{strconv.Itoa(schedulerBatchSize), kind, streamField}).AsInt64()
+				if err != nil {
+					if ctx.Err() == nil {
+						logger.Warn("[%s] error moving retries of %s: %s", sub.name, topic, err.Error())
+					}
+					break
+				}
+				if count < schedulerBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// retryKey is the key of the sorted set holding the scheduled retries of the subscriber topic messages
+func retryKey(topic, subscriberName string) string {
+	return fmt.Sprintf("{%s}:retry:%s", topic, subscriberName)
+}
+
+// retryStreamKey is the stream of the due retries of the topic messages read by the stream consumer group
+func retryStreamKey(topic, group string) string {
+	return fmt.Sprintf("%s:due", retryKey(topic, group))
+}
+
+// endregion
@@ -0,0 +1,167 @@
+// Stream replay: past messages of the topic streams are read again from an offset (entry id or time)
+//
+
+package facilities
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// Well known stream offsets
+const (
+	OffsetEarliest StreamOffset = "earliest" // The first message of the stream
+	OffsetLatest   StreamOffset = "latest"   // The last message of the stream (new messages for subscription)
+)
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// StreamOffset is a position in the topic stream: OffsetEarliest, OffsetLatest or stream entry id (see OffsetFromId
+// and OffsetFromTime)
+type StreamOffset string
+
+// OffsetFromId returns the offset of the stream entry id (e.g. the id of a dead letter or replay error)
+func OffsetFromId(id string) StreamOffset {
+	return StreamOffset(id)
+}
+
+// OffsetFromTime returns the offset of the first stream entry added at the given time or later
+func OffsetFromTime(t time.Time) StreamOffset {
+	return StreamOffset(fmt.Sprintf("%d-0", t.UnixMilli()))
+}
+
+// IStreamReplay is implemented by the Valkey stream bus to read past messages of the topic streams
+// Messages are read directly from the stream, the consumer groups offsets and pending messages are not changed
+type IStreamReplay interface {
+
+	// Replay delivers the topic messages between the offsets (inclusive) to the callback in order, return the number of
+	// replayed messages. The replay stops when the callback rejects a message or panics
+	Replay(topic string, factory MessageFactory, from, to StreamOffset, callback SubscriptionCallback) (int64, error)
+}
+
+// IStreamConsumer is implemented by the Valkey stream bus to create consumers with subscription options, e.g. the offset
+// a new consumer group starts from (see StartFrom)
+type IStreamConsumer interface {
+
+	// CreateConsumerWith creates message consumer for a specific topic with the subscription options, the options
+	// override the subscription defaults of the message bus
+	CreateConsumerWith(subscription string, mf MessageFactory, options []SubscriptionOption, topics ...string) (IMessageConsumer, error)
+}
+
+// endregion
+
+// region Stream replay actions ----------------------------------------------------------------------------------------
+
+// Replay delivers the topic messages between the offsets (inclusive) to the callback in order, return the number of
+// replayed messages. The replay stops when the callback rejects a message or panics, the error includes the id of the
+// message to resume from. Expired messages and messages which can't be decoded are skipped as in live consumption
+func (r *ValkeyStreamBus) Replay(topic string, factory MessageFactory, from, to StreamOffset, callback SubscriptionCallback) (int64, error) {
+
+	// Validate callback
+	if callback == nil {
+		return 0, fmt.Errorf("callback is nil")
+	}
+
+	// The end of the replay is fixed when it starts, messages added during the replay are not replayed
+	end, err := r.rangeEnd(topic, to)
+	if err != nil || len(end) == 0 {
+		return 0, err
+	}
+	start := from.rangeStart()
+
+	count := int64(0)
+	for r.ctx.Err() == nil {
+		cmd := r.rc.B().Xrange().Key(topic).Start(start).End(end).Count(streamReadCount).Build()
+		entries, er := r.rc.Do(r.ctx, cmd).AsXRange()
+		if er != nil {
+			return count, er
+		}
+
+		for _, entry := range entries {
+			raw, ok := entry.FieldValues[streamField]
+			if !ok || isExpired([]byte(raw)) {
+				continue
+			}
+			message, e := rawToMessage(factory, []byte(raw))
+			if e != nil {
+				logger.Warn("[replay] error decoding message %s from %s: %s", entry.ID, topic, e.Error())
+				continue
+			}
+			if e = invoke(callback, message); e != nil {
+				return count, fmt.Errorf("replay of %s stopped at message %s: %s", topic, entry.ID, e.Error())
+			}
+			count++
+		}
+
+		if len(entries) < streamReadCount {
+			return count, nil
+		}
+		start = nextId(entries[len(entries)-1].ID)
+	}
+	return count, r.ctx.Err()
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// rangeStart returns the first entry id of range starting at the offset
+func (o StreamOffset) rangeStart() string {
+	switch o {
+	case "", OffsetEarliest:
+		return "-"
+	case OffsetLatest:
+		return "+"
+	default:
+		return string(o)
+	}
+}
+
+// groupStart returns the last delivered id of consumer group starting at the offset, the next entry is the first
+// delivered to the group
+func (o StreamOffset) groupStart() string {
+	switch o {
+	case "", OffsetLatest:
+		return "$"
+	case OffsetEarliest:
+		return "0"
+	default:
+		return prevId(string(o))
+	}
+}
+
+// rangeEnd returns the last entry id of range ending at the offset, the latest offset is the last entry of the stream
+// (empty if the stream is empty)
+func (r *ValkeyStreamBus) rangeEnd(topic string, to StreamOffset) (string, error) {
+	switch to {
+	case "", OffsetLatest:
+		entries, err := r.rc.Do(r.ctx, r.rc.B().Xrevrange().Key(topic).End("+").Start("-").Count(1).Build()).AsXRange()
+		if err != nil || len(entries) == 0 {
+			return "", err
+		}
+		return entries[0].ID, nil
+	case OffsetEarliest:
+		return "-", nil
+	default:
+		return string(to), nil
+	}
+}
+
+// prevId returns the highest stream entry id preceding the given id
+func prevId(id string) string {
+	ms, seq := parseId(id)
+	switch {
+	case seq > 0:
+		return fmt.Sprintf("%d-%d", ms, seq-1)
+	case ms > 0:
+		return fmt.Sprintf("%d-%d", ms-1, uint64(math.MaxUint64))
+	default:
+		return "0-0"
+	}
+}
+
+// endregion
@@ -0,0 +1,242 @@
+// Stream retention: the topic streams of the stream bus are trimmed by length, age or acknowledgement
+//
+
+package facilities
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+)
+
+// retentionInterval is the interval between trims of the topic streams with retention policy
+const retentionInterval = time.Second * 30
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// RetentionPolicy defines the entries kept in a topic stream (see WithStreamRetention), entries beyond any of the limits
+// are trimmed. When Acked is set, only entries acknowledged by all the consumer groups of the topic are trimmed (all
+// of them if no limit is set) and the stream is not trimmed while it has no consumer groups
+type RetentionPolicy struct {
+	MaxLen int64         // Maximum number of entries (0 for no limit)
+	MaxAge time.Duration // Maximum age of entries (0 for no limit)
+	Acked  bool          // Trim only entries acknowledged by all the consumer groups
+}
+
+// IStreamRetention is implemented by the Valkey stream bus configured with retention policies
+// Policies without Acked are applied approximately on publish (XADD MAXLEN ~ or MINID ~), all the policies are applied
+// exactly by a periodic trimmer of the message bus
+type IStreamRetention interface {
+
+	// Trim the topic streams by their retention policy (all the topics with retention policy if not specified), return
+	// the number of trimmed entries
+	Trim(topics ...string) (int64, error)
+}
+
+// endregion
+
+// region Stream retention actions -------------------------------------------------------------------------------------
+
+// Trim the topic streams by their retention policy (all the topics with retention policy if not specified), return
+// the number of trimmed entries
+func (r *ValkeyStreamBus) Trim(topics ...string) (int64, error) {
+
+	if len(topics) == 0 {
+		for topic := range r.config.retention {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+	}
+
+	total := int64(0)
+	for _, topic := range topics {
+		policy, ok := r.config.retention[topic]
+		if !ok {
+			return total, fmt.Errorf("topic %s has no retention policy", topic)
+		}
+		if count, err := r.trim(topic, policy); err != nil {
+			return total, err
+		} else {
+			total += count
+		}
+	}
+	return total, nil
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// lengthBoundScript returns the id of the first entry kept when the stream is trimmed to the max length (nil if the
+// stream is not longer than the max length)
+// KEYS[1] - the stream, ARGV[1] - max length
+var lengthBoundScript = valkey.NewLuaScript(`
+local excess = redis.call('XLEN', KEYS[1]) - tonumber(ARGV[1])
+if excess <= 0 then
+	return false
+end
+local entries = redis.call('XRANGE', KEYS[1], '-', '+', 'COUNT', excess + 1)
+return entries[#entries][1]
+`)
+
+// xaddCommand builds the command adding the raw message to the topic stream, the retention limits of policy without
+// Acked are applied approximately (the max length is preferred when both limits are set)
+func xaddCommand(rc valkey.Client, policy RetentionPolicy, topic, raw string) valkey.Completed {
+	switch {
+	case policy.Acked:
+		return rc.B().Xadd().Key(topic).Id("*").FieldValue().FieldValue(streamField, raw).Build()
+	case policy.MaxLen > 0:
+		threshold := strconv.FormatInt(policy.MaxLen, 10)
+		return rc.B().Xadd().Key(topic).Maxlen().Almost().Threshold(threshold).Id("*").FieldValue().FieldValue(streamField, raw).Build()
+	case policy.MaxAge > 0:
+		threshold := ageBound(policy.MaxAge)
+		return rc.B().Xadd().Key(topic).Minid().Almost().Threshold(threshold).Id("*").FieldValue().FieldValue(streamField, raw).Build()
+	default:
+		return rc.B().Xadd().Key(topic).Id("*").FieldValue().FieldValue(streamField, raw).Build()
+	}
+}
+
+// trim removes the entries of the topic stream beyond the limits of the retention policy, the entries are trimmed up
+// to a single bound: the highest bound of the limits, lowered to the first entry not acknowledged when Acked is set
+func (r *ValkeyStreamBus) trim(topic string, policy RetentionPolicy) (int64, error) {
+
+	bound := ""
+	if policy.MaxAge > 0 {
+		bound = ageBound(policy.MaxAge)
+	}
+	if policy.MaxLen > 0 {
+		id, err := lengthBoundScript.Exec(r.ctx, r.rc, []string{topic}, []string{strconv.FormatInt(policy.MaxLen, 10)}).ToString()
+		if err != nil && !valkey.IsValkeyNil(err) {
+			return 0, err
+		}
+		if err == nil && (len(bound) == 0 || compareIds(id, bound) > 0) {
+			bound = id
+		}
+	}
+
+	if policy.Acked {
+		floor, err := r.ackedFloor(topic)
+		if err != nil || len(floor) == 0 {
+			return 0, err
+		}
+		if policy.MaxLen == 0 && policy.MaxAge == 0 {
+			bound = floor
+		} else if len(bound) > 0 && compareIds(floor, bound) < 0 {
+			bound = floor
+		}
+	}
+
+	if len(bound) == 0 {
+		return 0, nil
+	}
+	return r.rc.Do(r.ctx, r.rc.B().Xtrim().Key(topic).Minid().Threshold(bound).Build()).AsInt64()
+}
+
+// ackedFloor returns the id of the first entry of the topic stream which is not acknowledged by all the consumer
+// groups (empty if the stream has no consumer groups): the first pending entry of the group, or the entry following the
+// last entry delivered to the group when nothing is pending
+func (r *ValkeyStreamBus) ackedFloor(topic string) (string, error) {
+
+	groups, err := r.rc.Do(r.ctx, r.rc.B().XinfoGroups().Key(topic).Build()).ToArray()
+	if err != nil {
+		// The stream does not exist, there is nothing to trim
+		if strings.Contains(err.Error(), "no such key") {
+			return "", nil
+		}
+		return "", err
+	}
+
+	floor := ""
+	for _, group := range groups {
+		fields, er := group.AsMap()
+		if er != nil {
+			return "", er
+		}
+		nameField, pendingField, lastField := fields["name"], fields["pending"], fields["last-delivered-id"]
+		name, _ := nameField.ToString()
+		pending, _ := pendingField.AsInt64()
+		last, _ := lastField.ToString()
+
+		lowest := nextId(last)
+		if pending > 0 {
+			// The summary reply is: [count, lowest id, highest id, consumers]
+			summary, e := r.rc.Do(r.ctx, r.rc.B().Xpending().Key(topic).Group(name).Build()).ToArray()
+			if e != nil {
+				return "", e
+			}
+			if len(summary) < 2 {
+				return "", fmt.Errorf("unexpected pending summary of group %s on %s", name, topic)
+			}
+			if lowest, e = summary[1].ToString(); e != nil {
+				return "", e
+			}
+		}
+		if len(floor) == 0 || compareIds(lowest, floor) < 0 {
+			floor = lowest
+		}
+	}
+	return floor, nil
+}
+
+// runTrimmer is a function running a loop which periodically trims the topic streams with retention policy until the
+// bus is closed
+func (r *ValkeyStreamBus) runTrimmer() {
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for topic, policy := range r.config.retention {
+			if _, err := r.trim(topic, policy); err != nil && r.ctx.Err() == nil {
+				logger.Warn("error trimming stream %s: %s", topic, err.Error())
+			}
+		}
+	}
+}
+
+// ageBound is the id of the first stream entry younger than the max age
+func ageBound(maxAge time.Duration) string {
+	return fmt.Sprintf("%d-0", time.Now().Add(-maxAge).UnixMilli())
+}
+
+// parseId splits the stream entry id to its time and sequence parts
+func parseId(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	m, _ := strconv.ParseUint(ms, 10, 64)
+	s, _ := strconv.ParseUint(seq, 10, 64)
+	return m, s
+}
+
+// compareIds compares stream entry ids, return -1 if a is lower than b, 1 if a is higher than b and 0 if equal
+func compareIds(a, b string) int {
+	am, as := parseId(a)
+	bm, bs := parseId(b)
+	switch {
+	case am < bm || (am == bm && as < bs):
+		return -1
+	case am > bm || (am == bm && as > bs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// nextId returns the lowest stream entry id following the given id
+func nextId(id string) string {
+	ms, seq := parseId(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// endregion
@@ -0,0 +1,168 @@
+// Worker pool: bounded processing of the subscription messages
+//
+
+package facilities
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/go-yaaf/yaaf-common/logger"
+	. "github.com/go-yaaf/yaaf-common/messaging"
+)
+
+// defaultConcurrency is the default maximum number of callbacks processing the messages of a subscription
+const defaultConcurrency = 100
+
+// region Data structure and methods  ----------------------------------------------------------------------------------
+
+// ISubscriber is implemented by the Valkey message bus to subscribe with specific subscription options
+type ISubscriber interface {
+
+	// SubscribeWith subscribe on topics with the subscription options (concurrency, ordering and buffering), the options
+	// override the subscription defaults of the message bus
+	SubscribeWith(subscriberName string, factory MessageFactory, callback SubscriptionCallback, options []SubscriptionOption, topics ...string) (string, error)
+}
+
+// workerPool processes the subscription messages by a bounded number of workers, messages are buffered until a worker
+// is available and the overflow policy is applied when the buffer is full
+type workerPool struct {
+	name        string
+	concurrency int
+	overflow    OverflowPolicy
+	queue       chan poolTask
+	done        chan struct{}
+	dropped     atomic.Uint64
+}
+
+// poolTask is a buffered task of the worker pool
+type poolTask struct {
+	run     func()
+	abandon func() // Called instead of run when the task is not processed before the subscription stops (optional)
+	release func() // Called when the task leaves the pool: processed, dropped or abandoned (optional)
+}
+
+// endregion
+
+// region PRIVATE SECTION ----------------------------------------------------------------------------------------------
+
+// newWorkerPool creates the worker pool of the subscription, the workers run from start until the done channel is closed
+func newWorkerPool(name string, config subscriptionConfig, done chan struct{}) *workerPool {
+
+	concurrency := config.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	bufferSize := config.bufferSize
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	return &workerPool{
+		name:        name,
+		concurrency: concurrency,
+		overflow:    config.overflow,
+		queue:       make(chan poolTask, bufferSize),
+		done:        done,
+	}
+}
+
+// start the workers
+func (p *workerPool) start() {
+	for i := 0; i < p.concurrency; i++ {
+		go p.worker()
+	}
+}
+
+// submit adds the task to the buffer according to the overflow policy, when the buffer is full and the submit is blocked
+// until the subscription context is canceled (or the pool stops) the task is abandoned
+func (p *workerPool) submit(ctx context.Context, run func(), abandon func()) {
+	p.enqueue(ctx, poolTask{run: run, abandon: abandon})
+}
+
+// enqueue adds the task to the buffer according to the overflow policy (see submit)
+func (p *workerPool) enqueue(ctx context.Context, task poolTask) {
+	switch p.overflow {
+	case OverflowDropNewest:
+		select {
+		case p.queue <- task:
+		default:
+			p.drop(task)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case p.queue <- task:
+				return
+			default:
+			}
+			select {
+			case oldest := <-p.queue:
+				p.drop(oldest)
+			default:
+			}
+		}
+	default:
+		select {
+		case p.queue <- task:
+		case <-ctx.Done():
+			task.discard()
+		case <-p.done:
+			task.discard()
+		}
+	}
+}
+
+// worker is a function running a loop which processes the buffered tasks until the subscription is done
+func (p *workerPool) worker() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case task := <-p.queue:
+			task.run()
+			task.done()
+		}
+	}
+}
+
+// drain abandons the buffered tasks which were not processed, it is called when the subscription stops after the
+// tasks are no longer submitted. The tasks are abandoned from the latest to the first
+func (p *workerPool) drain() {
+	tasks := make([]poolTask, 0, len(p.queue))
+	for len(p.queue) > 0 {
+		select {
+		case task := <-p.queue:
+			tasks = append(tasks, task)
+		default:
+		}
+	}
+	for i := len(tasks) - 1; i >= 0; i-- {
+		tasks[i].discard()
+	}
+}
+
+// discard calls the abandon function of the task, if any
+func (t poolTask) discard() {
+	if t.abandon != nil {
+		t.abandon()
+	}
+	t.done()
+}
+
+// done calls the release function of the task, if any
+func (t poolTask) done() {
+	if t.release != nil {
+		t.release()
+	}
+}
+
+// drop counts the dropped message and reports the first and then every thousand dropped messages
+func (p *workerPool) drop(task poolTask) {
+	task.done()
+	if count := p.dropped.Add(1); count%1000 == 1 {
+		logger.Warn("[%s] subscription buffer is full, %d messages dropped", p.name, count)
+	}
+}
+
+// endregion